@@ -79,6 +79,13 @@ func (cmd *CheckCommand) checkETHSegment(path string) error {
 	fmt.Printf("CAP: %d items\n", s.Cap())
 	fmt.Printf("CHKSUM: %x\n", s.Checksum())
 
+	// Print region layout.
+	layout := s.Layout()
+	fmt.Printf("HEADER: offset=%d size=%d\n", layout.Header.Offset, layout.Header.Size)
+	fmt.Printf("DATA: offset=%d size=%d\n", layout.Data.Offset, layout.Data.Size)
+	fmt.Printf("INDEX: offset=%d size=%d\n", layout.Index.Offset, layout.Index.Size)
+	fmt.Printf("TRAILING: %d bytes\n", layout.Trailing)
+
 	// Verify checksum integrity.
 	if chksum, err := ethdb.ChecksumFileSegment(path); err != nil {
 		return err
@@ -29,6 +29,8 @@ func run(args []string) error {
 		return NewCheckCommand().Run(args)
 	case "keys":
 		return NewKeysCommand().Run(args)
+	case "reindex":
+		return NewReindexCommand().Run(args)
 	default:
 		return fmt.Errorf("unknown command: %q", cmd)
 	}
@@ -47,5 +49,6 @@ The commands are:
 	check       verify integrity of a segment
 	help        print this screen
 	keys        dump all keys for a table
+	reindex     rebuild the index of a file segment from its data
 `[1:])
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+type ReindexCommand struct{}
+
+func NewReindexCommand() *ReindexCommand {
+	return &ReindexCommand{}
+}
+
+func (cmd *ReindexCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("gochain-ethdb-reindex", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 {
+		return errors.New("path required")
+	}
+
+	// Rebuild index for each path passed in.
+	for _, path := range fs.Args() {
+		if err := ethdb.ReindexFileSegment(path); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		fmt.Printf("%s: reindexed\n", path)
+	}
+	return nil
+}
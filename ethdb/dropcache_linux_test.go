@@ -0,0 +1,19 @@
+// +build linux
+
+package ethdb_test
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// DropPageCache asks the kernel to evict the cached pages of the file at path.
+func DropPageCache(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
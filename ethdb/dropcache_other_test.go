@@ -0,0 +1,6 @@
+// +build !linux
+
+package ethdb_test
+
+// DropPageCache is a no-op on platforms without posix_fadvise().
+func DropPageCache(path string) error { return nil }
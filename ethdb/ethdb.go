@@ -49,6 +49,39 @@ type SegmentIterator interface {
 	Value() []byte
 }
 
+// Iteratee is implemented by stores that can iterate over a range of keys.
+// Iterators return keys beginning with prefix that are greater than or equal
+// to prefix+start.
+type Iteratee interface {
+	NewIterator(prefix, start []byte) SegmentIterator
+}
+
+// KeyValue represents a key/value pair returned by an iterator.
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// FilterIterator returns an iterator that only returns entries from itr for
+// which pred returns true. Closing the returned iterator closes itr.
+func FilterIterator(itr SegmentIterator, pred func(key, value []byte) bool) SegmentIterator {
+	return &filterIterator{SegmentIterator: itr, pred: pred}
+}
+
+type filterIterator struct {
+	SegmentIterator
+	pred func(key, value []byte) bool
+}
+
+func (itr *filterIterator) Next() bool {
+	for itr.SegmentIterator.Next() {
+		if itr.pred(itr.Key(), itr.Value()) {
+			return true
+		}
+	}
+	return false
+}
+
 // SegmentOpener represents an object that can instantiate and load an immutable segment.
 type SegmentOpener interface {
 	OpenSegment(table, name, path string) (Segment, error)
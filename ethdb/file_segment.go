@@ -3,6 +3,7 @@ package ethdb
 import (
 	"bufio"
 	"bytes"
+	"container/heap"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
@@ -12,17 +13,32 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/edsrzf/mmap-go"
 	"github.com/bcskill/bcschain/v3/common"
 	"github.com/bcskill/bcschain/v3/log"
+	"github.com/bcskill/bcschain/v3/metrics"
 )
 
 var (
 	ErrImmutableSegment            = errors.New("ethdb: immutable segment")
 	ErrSegmentTypeUnknown          = errors.New("ethdb: segment type unknown")
 	ErrFileSegmentChecksumMismatch = errors.New("ethdb: file segment checksum mismatch")
+	ErrFileSegmentBadMagic         = errors.New("ethdb: not a file segment, bad magic")
+	ErrFileSegmentNoIndex          = errors.New("ethdb: file segment has no index")
+	ErrFileSegmentRangeOverlap     = errors.New("ethdb: file segment key ranges overlap")
+	ErrFileSegmentValueTooLarge    = errors.New("ethdb: file segment value exceeds MaxGetValueSize, use AppendValue or Iterator")
+	ErrFileSegmentUnsorted         = errors.New("ethdb: file segment keys must be sorted")
+	ErrFileSegmentCorrupt          = errors.New("ethdb: file segment corrupt")
+	ErrFileSegmentTruncated        = errors.New("ethdb: file segment truncated")
+	ErrFileSegmentDuplicateKey     = errors.New("ethdb: duplicate key written to file segment")
+	ErrFileSegmentClosed           = errors.New("ethdb: file segment closed")
+	ErrFileSegmentBadOffset        = errors.New("ethdb: invalid file segment entry offset")
+	ErrFileSegmentNotReopenable    = errors.New("ethdb: file segment created from a file cannot be reopened")
 )
 
 const (
@@ -50,32 +66,112 @@ const (
 		FileSegmentIndexCapacitySize
 )
 
+// DefaultFileSegmentProgressInterval is the default number of entries
+// indexed between encoder progress callbacks.
+const DefaultFileSegmentProgressInterval = 10000
+
+// FileSegmentAccessTimeResolution is the interval after which a read updates
+// a segment's access time.
+const FileSegmentAccessTimeResolution = time.Second
+
+// DefaultMaxGetValueSize is the default limit on the size of a value
+// returned by FileSegment.Get.
+const DefaultMaxGetValueSize = 64 * 1024 * 1024
+
+// Only one in fileSegmentMetricsSampleRate value lookups is recorded in the
+// histograms below so the hot path rarely takes the sample lock.
+const fileSegmentMetricsSampleRate = 16
+
+var (
+	// Number of index slots probed per value lookup & the file offset of matched entries.
+	fileSegmentProbesHistogram = metrics.NewRegisteredHistogram("ethdb/segment/file/probes", nil, metrics.NewExpDecaySample(1028, 0.015))
+	fileSegmentOffsetHistogram = metrics.NewRegisteredHistogram("ethdb/segment/file/offset", nil, metrics.NewExpDecaySample(1028, 0.015))
+)
+
 // Ensure implementation implements interface.
 var _ Segment = (*FileSegment)(nil)
+var _ io.WriterTo = (*FileSegment)(nil)
 
 // FileSegment represents an immutable key/value file segment for a table.
 type FileSegment struct {
+	atime   int64  // last read, in unix nanoseconds; accessed atomically
+	lookups uint64 // value lookups, for metrics sampling; accessed atomically
+
 	name string // segment name
 	path string // on-disk path
 	data []byte // memory-mapped data
 	file *os.File // file backing data
+
+	mapped      bool // true if data is memory-mapped
+	indexLocked bool // true if index region is mlocked
+	closed      bool // true after Close() until reopened
+	fromFile    bool // true if created from a file; Open() never reopens path
+
+	// If true, the index region is locked into memory on Open() so lookups
+	// are never delayed by page faults. Lock failures are logged unless
+	// LockIndexStrict is also set, in which case Open() returns an error.
+	LockIndex       bool
+	LockIndexStrict bool
+
+	// If greater than zero, iterators advise the kernel to read ahead this
+	// many bytes past their position so cold mappings fault in fewer pages.
+	PrefetchWindow int
+
+	// Largest value, in bytes, that Get will copy into a new allocation.
+	// Larger values return ErrFileSegmentValueTooLarge. Zero disables the limit.
+	MaxGetValueSize int
 }
 
 // NewFileSegment returns a new instance of FileSegment.
 func NewFileSegment(name, path string) *FileSegment {
 	return &FileSegment{
-		name: name,
-		path: path,
+		name:            name,
+		path:            path,
+		MaxGetValueSize: DefaultMaxGetValueSize,
+	}
+}
+
+// NewFileSegmentFromBytes returns a file segment that reads directly from b.
+// The segment is ready to use and must not be opened. Closing it does not
+// modify b. This is mainly useful for tests that encode to memory.
+func NewFileSegmentFromBytes(name string, b []byte) (*FileSegment, error) {
+	s := &FileSegment{name: name, data: b, MaxGetValueSize: DefaultMaxGetValueSize}
+	if err := s.validateHeader(); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
+
+// NewFileSegmentFromFile returns an opened file segment that takes ownership
+// of f, such as a file descriptor inherited from a parent process. The path
+// is never reopened so Open() returns ErrFileSegmentNotReopenable. Such
+// segments must not be placed in a SegmentSet, which reopens segments after
+// eviction. Closing the segment closes f, as does any error.
+func NewFileSegmentFromFile(name string, f *os.File) (*FileSegment, error) {
+	s := NewFileSegment(name, f.Name())
+	s.fromFile = true
+	if err := s.openFile(f); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // Open opens and initializes the file segment.
 func (s *FileSegment) Open() error {
+	if s.fromFile {
+		return ErrFileSegmentNotReopenable
+	}
 	file, err := os.Open(s.path)
 	if err != nil {
 		log.Error("Cannot open file segment", "path", s.path, "err", err)
 		return err
 	}
+	return s.openFile(file)
+}
+
+// openFile memory-maps & initializes the segment from file. The file is
+// closed if an error occurs.
+func (s *FileSegment) openFile(file *os.File) error {
 	s.file = file
 
 	// Memory-map data.
@@ -83,27 +179,77 @@ func (s *FileSegment) Open() error {
 	if err != nil {
 		log.Error("Cannot mmap file segment", "path", s.path, "err", err)
 		file.Close()
+		s.file = nil
 		return err
 	}
-	s.data = []byte(data)
+	s.data, s.mapped, s.closed = []byte(data), true, false
 
 	// Ensure header information is valid.
-	if len(data) < FileSegmentHeaderSize {
-		s.Close()
-		return errors.New("ethdb: file header too short")
-	} else if string(data[:len(FileSegmentMagic)]) != FileSegmentMagic {
+	if err := s.validateHeader(); err != nil {
 		s.Close()
-		return errors.New("ethdb: invalid ethdb file")
+		return err
+	}
+
+	// Lock index into memory, if requested.
+	if s.LockIndex {
+		if err := mlock(s.Index()); err == nil {
+			s.indexLocked = true
+		} else if s.LockIndexStrict {
+			s.Close()
+			return fmt.Errorf("ethdb: cannot lock file segment index: %s", err)
+		} else {
+			log.Warn("Cannot lock file segment index", "path", s.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// checkFileSegmentMagic returns an error if b does not begin with a complete
+// file segment header. A bad magic error includes the bytes that were found.
+func checkFileSegmentMagic(b []byte) error {
+	if len(b) < FileSegmentHeaderSize {
+		return fmt.Errorf("%w: header too short: %d bytes", ErrFileSegmentTruncated, len(b))
+	} else if magic := b[:len(FileSegmentMagic)]; string(magic) != FileSegmentMagic {
+		return fmt.Errorf("%w: got %q, expected %q", ErrFileSegmentBadMagic, magic, FileSegmentMagic)
+	}
+	return nil
+}
+
+// validateHeader ensures the magic is present and the index location
+// described by the header is within the file.
+func (s *FileSegment) validateHeader() error {
+	if err := checkFileSegmentMagic(s.data); err != nil {
+		return err
+	}
+
+	indexOffset, count, capacity := s.IndexOffset(), uint64(s.Len()), uint64(s.Cap())
+	if indexOffset < int64(FileSegmentHeaderSize) || indexOffset > int64(len(s.data)) {
+		return fmt.Errorf("%w: index offset out of bounds: %d", ErrFileSegmentCorrupt, indexOffset)
+	} else if capacity&(capacity-1) != 0 {
+		return fmt.Errorf("%w: index capacity not a power of two: %d", ErrFileSegmentCorrupt, capacity)
+	} else if capacity > uint64(int64(len(s.data))-indexOffset)/8 {
+		return fmt.Errorf("%w: index truncated: capacity=%d", ErrFileSegmentTruncated, capacity)
+	} else if capacity != 0 && count > capacity {
+		return fmt.Errorf("%w: index count exceeds capacity: count=%d capacity=%d", ErrFileSegmentCorrupt, count, capacity)
 	}
 	return nil
 }
 
-// Close closes the file and its mmap.
+// Close closes the file and its mmap. Later reads return ErrFileSegmentClosed
+// until the segment is reopened. Close must not be called concurrently with
+// reads; the guard only catches use after Close has returned.
 func (s *FileSegment) Close() (err error) {
-	if s.data != nil {
-		err = (*mmap.MMap)(&s.data).Unmap()
-		s.data = nil
+	if s.indexLocked {
+		err = munlock(s.Index())
+		s.indexLocked = false
+	}
+	if s.mapped {
+		if uerr := (*mmap.MMap)(&s.data).Unmap(); uerr != nil && err == nil {
+			err = uerr
+		}
+		s.mapped = false
 	}
+	s.data, s.closed = nil, true
 	if s.file != nil {
 		if ferr := s.file.Close(); ferr != nil && err == nil {
 			err = ferr
@@ -116,6 +262,25 @@ func (s *FileSegment) Close() (err error) {
 // Name returns the name of the segment.
 func (s *FileSegment) Name() string { return s.name }
 
+// AccessTime returns the time the segment was last read by a lookup or an
+// iterator. Returns the zero time if the segment has not been read. Access
+// time is tracked in memory only and only to within FileSegmentAccessTimeResolution.
+func (s *FileSegment) AccessTime() time.Time {
+	if ns := atomic.LoadInt64(&s.atime); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// touch updates the access time to the current time. The shared word is only
+// written once it is stale so concurrent readers rarely contend on it.
+func (s *FileSegment) touch() {
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&s.atime) >= int64(FileSegmentAccessTimeResolution) {
+		atomic.StoreInt64(&s.atime, now)
+	}
+}
+
 // Path returns the path of the segment.
 func (s *FileSegment) Path() string { return s.path }
 
@@ -129,6 +294,36 @@ func (s *FileSegment) Data() []byte {
 	return s.data
 }
 
+// WriteTo writes the raw segment file to w. Implements io.WriterTo.
+// Returns ErrFileSegmentClosed if the segment is closed.
+func (s *FileSegment) WriteTo(w io.Writer) (int64, error) {
+	if s.closed {
+		return 0, ErrFileSegmentClosed
+	}
+	n, err := w.Write(s.data)
+	return int64(n), err
+}
+
+// Layout returns the offsets & sizes of each region in the segment file.
+func (s *FileSegment) Layout() FileSegmentLayout {
+	indexOffset := s.IndexOffset()
+	indexSize := int64(s.Cap()) * 8
+	return FileSegmentLayout{
+		Header:   FileSegmentRegion{Offset: 0, Size: int64(FileSegmentHeaderSize)},
+		Data:     FileSegmentRegion{Offset: int64(FileSegmentHeaderSize), Size: indexOffset - int64(FileSegmentHeaderSize)},
+		Index:    FileSegmentRegion{Offset: indexOffset, Size: indexSize},
+		Trailing: int64(len(s.data)) - indexOffset - indexSize,
+	}
+}
+
+// FileSegmentLayout represents the location of each region within a file segment.
+type FileSegmentLayout struct {
+	Header   FileSegmentRegion
+	Data     FileSegmentRegion
+	Index    FileSegmentRegion
+	Trailing int64 // bytes after the index, normally zero
+}
+
 // Checksum returns the checksum written to the segment file.
 func (s *FileSegment) Checksum() []byte {
 	if len(s.data) < len(FileSegmentMagic)+FileSegmentChecksumSize {
@@ -171,49 +366,404 @@ func (s *FileSegment) Cap() int {
 	return int(binary.BigEndian.Uint64(data[:FileSegmentIndexCapacitySize]))
 }
 
+// Indexed returns true if the segment was encoded with an index.
+// Segments without an index only support iteration.
+func (s *FileSegment) Indexed() bool {
+	return s.Cap() != 0
+}
+
 // Has returns true if the key exists.
 func (s *FileSegment) Has(key []byte) (bool, error) {
-	koff, _ := s.offset(key)
-	return koff != 0, nil
+	s.touch()
+
+	if s.closed {
+		return false, ErrFileSegmentClosed
+	} else if !s.Indexed() {
+		return false, ErrFileSegmentNoIndex
+	}
+	koff, _, err := s.offset(key)
+	return koff != 0, err
+}
+
+// HasBatch returns whether each key exists. Results are in the same order as keys.
+func (s *FileSegment) HasBatch(keys [][]byte) ([]bool, error) {
+	s.touch()
+
+	if s.closed {
+		return nil, ErrFileSegmentClosed
+	} else if !s.Indexed() {
+		return nil, ErrFileSegmentNoIndex
+	}
+
+	a := make([]bool, len(keys))
+	for i, key := range keys {
+		koff, _, err := s.offset(key)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = koff != 0
+	}
+	return a, nil
 }
 
 // Get returns the value of the given key.
+//
+// The encoder rejects duplicate keys. If a malformed segment contains them
+// anyway, Get returns the entry in the first matching slot in probe order
+// from the key's home slot, regardless of which entry was written first.
 func (s *FileSegment) Get(key []byte) ([]byte, error) {
+	value, err := s.value(key)
+	if err != nil {
+		return nil, err
+	} else if s.MaxGetValueSize > 0 && len(value) > s.MaxGetValueSize {
+		return nil, ErrFileSegmentValueTooLarge
+	}
+	return common.CopyBytes(value), nil
+}
+
+// AppendValue appends the value of the given key to dst and returns the
+// extended buffer. No allocation is made if dst has enough capacity.
+func (s *FileSegment) AppendValue(dst, key []byte) ([]byte, error) {
+	value, err := s.value(key)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, value...), nil
+}
+
+// GetEntry reads the given key and its value into e, reusing the capacity of
+// e.Key and e.Value. No allocation is made once e is large enough. Returns
+// common.ErrNotFound without modifying e if the key does not exist.
+func (s *FileSegment) GetEntry(key []byte, e *KeyValue) error {
+	value, err := s.value(key)
+	if err != nil {
+		return err
+	}
+	e.Key = append(e.Key[:0], key...)
+	e.Value = append(e.Value[:0], value...)
+	return nil
+}
+
+// value returns the value of the given key as a slice of the mmap.
+// Lookups are sampled into the probe & offset histograms.
+func (s *FileSegment) value(key []byte) ([]byte, error) {
+	return s.lookup(key, true)
+}
+
+// lookup returns the value of the given key as a slice of the mmap. If record
+// is true, the lookup may be sampled into the probe & offset histograms.
+func (s *FileSegment) lookup(key []byte, record bool) ([]byte, error) {
+	s.touch()
+
 	defer func() {
 		if r := recover(); r != nil {
-			log.Error("Cannot read key in file segment", "path", s.path, "key", fmt.Sprintf("%x", key))
+			log.Error("Cannot read key in file segment", "path", s.path, "key", hex.EncodeToString(key))
 			panic(r)
 		}
 	}()
 
-	_, voff := s.offset(key)
+	if s.closed {
+		return nil, ErrFileSegmentClosed
+	} else if !s.Indexed() {
+		return nil, ErrFileSegmentNoIndex
+	}
+
+	koff, voff, probes, err := s.probe(key)
+	if err != nil {
+		return nil, err
+	}
+	if record && atomic.AddUint64(&s.lookups, 1)%fileSegmentMetricsSampleRate == 0 {
+		fileSegmentProbesHistogram.Update(int64(probes))
+		if koff != 0 {
+			fileSegmentOffsetHistogram.Update(koff)
+		}
+	}
 	if voff == 0 {
 		return nil, common.ErrNotFound
 	}
 
 	// Read value.
-	data := s.data[voff:]
-	n, sz := binary.Uvarint(data)
-	return common.CopyBytes(data[sz : sz+int(n) : sz+int(n)]), nil
+	value, _, ok := readFileSegmentBytes(s.data[:s.IndexOffset()], voff)
+	if !ok {
+		return nil, ErrFileSegmentCorrupt
+	}
+	return value, nil
+}
+
+// GetAtOffset returns copies of the key & value of the entry at offset, as
+// reported by OffsetIterator. The index is not consulted. Returns
+// ErrFileSegmentBadOffset if offset is outside the data region or the length
+// prefixes at offset do not describe an entry within it.
+func (s *FileSegment) GetAtOffset(offset int64) (key, value []byte, err error) {
+	s.touch()
+
+	if s.closed {
+		return nil, nil, ErrFileSegmentClosed
+	}
+
+	data := s.data[:s.IndexOffset()]
+	if offset < int64(FileSegmentHeaderSize) || offset >= int64(len(data)) {
+		return nil, nil, fmt.Errorf("%w: %d", ErrFileSegmentBadOffset, offset)
+	}
+	key, value, _, ok := readFileSegmentEntry(data, offset)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %d", ErrFileSegmentBadOffset, offset)
+	}
+	return common.CopyBytes(key), common.CopyBytes(value), nil
+}
+
+// Prewarm faults in the pages read by lookups of keys so subsequent calls to
+// Get() do not block on disk. Index & key pages are read by the lookup itself
+// and value pages are hinted to the kernel with madvise. Keys that do not
+// exist are ignored.
+func (s *FileSegment) Prewarm(keys [][]byte) error {
+	if s.closed {
+		return ErrFileSegmentClosed
+	} else if !s.Indexed() {
+		return ErrFileSegmentNoIndex
+	}
+
+	pageSize := int64(os.Getpagesize())
+	data := s.data[:s.IndexOffset()]
+	for _, key := range keys {
+		_, voff, err := s.offset(key)
+		if err != nil {
+			return err
+		} else if voff == 0 {
+			continue
+		}
+
+		_, end, ok := readFileSegmentBytes(data, voff)
+		if !ok {
+			return ErrFileSegmentCorrupt
+		} else if !s.mapped {
+			continue
+		}
+		if err := madviseWillNeed(data[(voff/pageSize)*pageSize : end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetOrDefault returns the value of the given key or def if the key does not
+// exist. Panics on any other error. See TryGetOrDefault for a non-panicking form.
+func (s *FileSegment) GetOrDefault(key, def []byte) []byte {
+	value, err := s.TryGetOrDefault(key, def)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// TryGetOrDefault returns the value of the given key or def if the key does
+// not exist. Errors other than common.ErrNotFound are returned. Unlike Get,
+// values larger than MaxGetValueSize are returned.
+func (s *FileSegment) TryGetOrDefault(key, def []byte) ([]byte, error) {
+	value, err := s.value(key)
+	if err == common.ErrNotFound {
+		return def, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return common.CopyBytes(value), nil
 }
 
 // Iterator returns an iterator for iterating over all key/value pairs.
 func (s *FileSegment) Iterator() SegmentIterator {
-	return &FileSegmentIterator{
+	s.touch()
+
+	if s.closed {
+		return &FileSegmentIterator{err: ErrFileSegmentClosed}
+	}
+
+	itr := &FileSegmentIterator{
+		data:   s.data[:s.IndexOffset()],
+		offset: int64(FileSegmentHeaderSize),
+		n:      -1,
+	}
+	if s.mapped {
+		itr.prefetch = int64(s.PrefetchWindow)
+	}
+	return itr
+}
+
+// OffsetIterator returns an iterator over all key/value pairs that also
+// reports the file offset & encoded length of each entry. Segments are
+// immutable so offsets remain valid for the lifetime of the file and may be
+// stored externally and read back with GetAtOffset.
+func (s *FileSegment) OffsetIterator() *FileSegmentIterator {
+	return s.Iterator().(*FileSegmentIterator)
+}
+
+// SliceIterator returns an iterator over the entries in positions
+// [start, start+limit) in data order. Bounds beyond Len() are clamped so an
+// out of range start returns an empty iterator.
+//
+// The data region has no positional index so the first start entries are
+// skipped by reading only their length prefixes.
+func (s *FileSegment) SliceIterator(start, limit int) *FileSegmentIterator {
+	s.touch()
+
+	if s.closed {
+		return &FileSegmentIterator{err: ErrFileSegmentClosed}
+	}
+	if start < 0 {
+		start = 0
+	}
+	if limit < 0 {
+		limit = 0
+	}
+
+	itr := &FileSegmentIterator{
 		data:   s.data[:s.IndexOffset()],
 		offset: int64(FileSegmentHeaderSize),
+		n:      limit,
+	}
+	for i := 0; i < start && itr.offset < int64(len(itr.data)); i++ {
+		_, _, next, ok := readFileSegmentEntry(itr.data, itr.offset)
+		if !ok {
+			itr.err = fmt.Errorf("%w: invalid entry at offset %d", ErrFileSegmentCorrupt, itr.offset)
+			itr.offset = int64(len(itr.data))
+			break
+		}
+		itr.offset = next
+	}
+	return itr
+}
+
+// TailIterator returns an iterator over the last n entries in data order.
+// n is clamped to Len(). The start offset is found from the entry offsets in
+// the index so earlier entries are not read. Segments without an index fall
+// back to SliceIterator.
+func (s *FileSegment) TailIterator(n int) *FileSegmentIterator {
+	s.touch()
+
+	if s.closed {
+		return &FileSegmentIterator{err: ErrFileSegmentClosed}
+	}
+	if l := s.Len(); n > l {
+		n = l
+	} else if n < 0 {
+		n = 0
+	}
+	if !s.Indexed() {
+		return s.SliceIterator(s.Len()-n, n)
+	}
+
+	data := s.data[:s.IndexOffset()]
+	itr := &FileSegmentIterator{data: data, offset: int64(len(data)), n: n}
+	if n == 0 {
+		return itr
+	}
+
+	// Keep the n largest entry offsets in a min-heap. The smallest of them is
+	// the start of the last n entries.
+	offsets, count := make(int64Heap, 0, n), 0
+	for idx := s.Index()[:s.Cap()*8]; len(idx) >= 8; idx = idx[8:] {
+		offset := int64(binary.BigEndian.Uint64(idx))
+		if offset == 0 {
+			continue
+		}
+		count++
+		if len(offsets) < n {
+			heap.Push(&offsets, offset)
+		} else if offset > offsets[0] {
+			offsets[0] = offset
+			heap.Fix(&offsets, 0)
+		}
+	}
+
+	if count < n {
+		itr.err = fmt.Errorf("%w: index has %d entries, expected %d", ErrFileSegmentCorrupt, count, s.Len())
+	} else if offset := offsets[0]; offset < int64(FileSegmentHeaderSize) || offset >= int64(len(data)) {
+		itr.err = fmt.Errorf("%w: invalid entry offset %d", ErrFileSegmentCorrupt, offset)
+	} else {
+		itr.offset = offset
 	}
+	return itr
+}
+
+// int64Heap is a min-heap of int64 values for use with container/heap.
+type int64Heap []int64
+
+func (h int64Heap) Len() int            { return len(h) }
+func (h int64Heap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h int64Heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *int64Heap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+func (h *int64Heap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// EntriesAt returns copies of the entries at the given positions in data
+// order. Results are returned in the same order as indices. Positions are
+// read in a single sorted pass over the data region so scattered positions
+// do not cause repeated scans. Returns an error identifying the first
+// position that is out of range.
+func (s *FileSegment) EntriesAt(indices []int) ([]KeyValue, error) {
+	s.touch()
+
+	if s.closed {
+		return nil, ErrFileSegmentClosed
+	}
+
+	n := s.Len()
+	for _, i := range indices {
+		if i < 0 || i >= n {
+			return nil, fmt.Errorf("ethdb: entry position out of range: %d (len=%d)", i, n)
+		}
+	}
+
+	// Sort request positions while remembering their place in the result.
+	order := make([]int, len(indices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return indices[order[a]] < indices[order[b]] })
+
+	data := s.data[:s.IndexOffset()]
+	a := make([]KeyValue, len(indices))
+	offset, pos := int64(FileSegmentHeaderSize), 0
+	for _, j := range order {
+		for ; pos < indices[j]; pos++ {
+			_, _, next, ok := readFileSegmentEntry(data, offset)
+			if !ok {
+				return nil, fmt.Errorf("%w: invalid entry at offset %d", ErrFileSegmentCorrupt, offset)
+			}
+			offset = next
+		}
+
+		key, value, _, ok := readFileSegmentEntry(data, offset)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid entry at offset %d", ErrFileSegmentCorrupt, offset)
+		}
+		a[j] = KeyValue{
+			Key:   append([]byte{}, key...),
+			Value: append([]byte{}, value...),
+		}
+	}
+	return a, nil
 }
 
 // offset returns the offset of key & value. Returns 0 if key does not exist.
-func (s *FileSegment) offset(key []byte) (koff, voff int64) {
+func (s *FileSegment) offset(key []byte) (koff, voff int64, err error) {
+	koff, voff, _, err = s.probe(key)
+	return koff, voff, err
+}
+
+// probe returns the offset of key & value and the number of index slots read.
+// Returns 0 offsets if key does not exist.
+func (s *FileSegment) probe(key []byte) (koff, voff int64, probes int, err error) {
 	capacity := uint64(s.Cap())
 	if capacity == 0 {
-		return 0, 0
+		return 0, 0, 0, nil
 	}
 	mask := capacity - 1
 
-	idx := s.Index()
+	data, idx := s.data[:s.IndexOffset()], s.Index()
 	hash := hashKey(key)
 	pos := hash & mask
 
@@ -221,25 +771,94 @@ func (s *FileSegment) offset(key []byte) (koff, voff int64) {
 		// Exit if empty slot found.
 		offset := int64(binary.BigEndian.Uint64(idx[pos*8:]))
 		if offset == 0 {
-			return 0, 0
+			return 0, 0, int(d + 1), nil
+		} else if offset < int64(FileSegmentHeaderSize) {
+			return 0, 0, int(d + 1), ErrFileSegmentCorrupt
 		}
 
 		// Read current key & compute hash.
-		data := s.data[offset:]
-		n, sz := binary.Uvarint(data)
-		curr := data[sz : sz+int(n)]
+		curr, next, ok := readFileSegmentBytes(data, offset)
+		if !ok {
+			return 0, 0, int(d + 1), ErrFileSegmentCorrupt
+		}
 		currHash := hashKey(curr)
 
 		// Exit if distance exceeds current slot or key matches.
 		if d > dist(currHash, pos, capacity, mask) {
-			return 0, 0
+			return 0, 0, int(d + 1), nil
 		} else if currHash == hash && bytes.Equal(curr, key) {
-			return offset, offset + int64(sz) + int64(n)
+			return offset, next, int(d + 1), nil
 		}
 		pos = (pos + 1) & mask
 	}
 }
 
+// AggregateRange folds the values of all keys in [start, end) into an
+// accumulator, starting from init. A nil start or end leaves that side
+// unbounded. Values passed to fn point into the segment and must not be
+// retained. Entries are stored in insertion order rather than sorted, so the
+// whole data region is scanned and fn is called in data order.
+func (s *FileSegment) AggregateRange(start, end []byte, fn func(acc, value []byte) []byte, init []byte) ([]byte, error) {
+	itr := s.Iterator()
+	defer itr.Close()
+
+	acc := init
+	for itr.Next() {
+		key := itr.Key()
+		if (start != nil && bytes.Compare(key, start) < 0) || (end != nil && bytes.Compare(key, end) >= 0) {
+			continue
+		}
+		acc = fn(acc, itr.Value())
+	}
+	if err := itr.Close(); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// SelfCheck iterates over every key/value pair and verifies that Get()
+// returns the same value as the iterator. This detects desync between the
+// data region and the index.
+func (s *FileSegment) SelfCheck() error {
+	itr := s.Iterator()
+
+	var n int
+	for ; itr.Next(); n++ {
+		v, err := s.value(itr.Key())
+		if err == common.ErrNotFound {
+			return &FileSegmentMismatchError{Key: common.CopyBytes(itr.Key()), IteratorValue: common.CopyBytes(itr.Value())}
+		} else if err != nil {
+			return err
+		} else if !bytes.Equal(v, itr.Value()) {
+			return &FileSegmentMismatchError{Key: common.CopyBytes(itr.Key()), IteratorValue: common.CopyBytes(itr.Value()), GetValue: common.CopyBytes(v)}
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
+
+	if n != s.Len() {
+		return fmt.Errorf("%w: length mismatch: header=%d iterated=%d", ErrFileSegmentCorrupt, s.Len(), n)
+	}
+	return nil
+}
+
+// FileSegmentMismatchError is returned by FileSegment.SelfCheck() when the
+// value returned by the index differs from the value in the data region.
+type FileSegmentMismatchError struct {
+	Key           []byte
+	IteratorValue []byte
+	GetValue      []byte // nil if key not found in index
+}
+
+// Error returns the string representation of the error.
+func (e *FileSegmentMismatchError) Error() string {
+	if e.GetValue == nil {
+		return fmt.Sprintf("ethdb: file segment key not found in index: key=%x", e.Key)
+	}
+	return fmt.Sprintf("ethdb: file segment value mismatch: key=%x iterator=%x get=%x", e.Key, e.IteratorValue, e.GetValue)
+}
+
 // Ensure implementation implements interface.
 var _ SegmentIterator = (*FileSegmentIterator)(nil)
 
@@ -248,16 +867,23 @@ var _ SegmentIterator = (*FileSegmentIterator)(nil)
 type FileSegmentIterator struct {
 	data   []byte
 	offset int64
+	curr   int64 // offset of current entry
+	n      int   // remaining entries, negative if unlimited
+	err    error
+
+	prefetch   int64 // read-ahead window, zero if disabled
+	prefetched int64 // end of region already advised
 
 	key   []byte
 	value []byte
 }
 
-// Close releases the iterator.
+// Close releases the iterator. Returns an error if iteration stopped early
+// because of a corrupt entry or the iterator was created on a closed segment.
 func (itr *FileSegmentIterator) Close() error {
 	itr.data, itr.offset = nil, 0
 	itr.key, itr.value = nil, nil
-	return nil
+	return itr.err
 }
 
 // Key returns the current key. Must be called after Next().
@@ -266,27 +892,188 @@ func (itr *FileSegmentIterator) Key() []byte { return itr.key }
 // Value returns the current key. Must be called after Next().
 func (itr *FileSegmentIterator) Value() []byte { return itr.value }
 
+// Entry returns the current key/value pair. Must be called after Next().
+// The returned slices are only valid until the segment is closed.
+func (itr *FileSegmentIterator) Entry() KeyValue {
+	return KeyValue{Key: itr.key, Value: itr.value}
+}
+
+// Offset returns the file offset of the current entry. Must be called after Next().
+func (itr *FileSegmentIterator) Offset() int64 { return itr.curr }
+
+// Length returns the encoded size of the current entry, including its
+// length prefixes. Must be called after Next().
+func (itr *FileSegmentIterator) Length() int { return int(itr.offset - itr.curr) }
+
 // Next reads the next key/value pair into the buffer.
 func (itr *FileSegmentIterator) Next() bool {
-	if itr.offset >= int64(len(itr.data)) {
+	if itr.offset >= int64(len(itr.data)) || itr.n == 0 {
 		return false
 	}
 
-	// Read key.
-	n, sz := binary.Uvarint(itr.data[itr.offset:])
-	itr.key = itr.data[itr.offset+int64(sz) : itr.offset+int64(sz+int(n))]
-	itr.offset += int64(sz + int(n))
+	// Advise the next window once the position passes the middle of the
+	// current one so read-ahead overlaps with iteration.
+	if itr.prefetch > 0 && itr.prefetched < int64(len(itr.data)) && itr.offset+itr.prefetch/2 >= itr.prefetched {
+		itr.advise()
+	}
 
-	// Read value.
-	n, sz = binary.Uvarint(itr.data[itr.offset:])
-	itr.value = itr.data[itr.offset+int64(sz) : itr.offset+int64(sz+int(n))]
-	itr.offset += int64(sz + int(n))
+	key, value, next, ok := readFileSegmentEntry(itr.data, itr.offset)
+	if !ok {
+		itr.err = fmt.Errorf("%w: invalid entry at offset %d", ErrFileSegmentCorrupt, itr.offset)
+		itr.offset, itr.key, itr.value = int64(len(itr.data)), nil, nil
+		return false
+	}
+	itr.curr, itr.key, itr.value, itr.offset = itr.offset, key, value, next
+	if itr.n > 0 {
+		itr.n--
+	}
 
 	return true
 }
 
+// advise issues a read-ahead hint for the window starting at the current
+// position. Hints are best effort so errors are ignored.
+func (itr *FileSegmentIterator) advise() {
+	pageSize := int64(os.Getpagesize())
+	start := (itr.offset / pageSize) * pageSize
+	end := itr.offset + itr.prefetch
+	if end > int64(len(itr.data)) {
+		end = int64(len(itr.data))
+	}
+	if start < end {
+		madviseWillNeed(itr.data[start:end])
+	}
+	itr.prefetched = end
+}
+
+// FileSegmentRegion represents a byte range within a file segment.
+type FileSegmentRegion struct {
+	Offset int64
+	Size   int64
+}
+
+// BestEffortIterator returns an iterator that skips over corrupt entries
+// instead of panicking. Entry offsets stored in the index are used to
+// resynchronize with the data region after a parse failure. Skipped regions
+// are available from the iterator's Skipped() method.
+func (s *FileSegment) BestEffortIterator() *FileSegmentBestEffortIterator {
+	// Clamp data region in case header is corrupt.
+	end := s.IndexOffset()
+	if end < int64(FileSegmentHeaderSize) || end > int64(len(s.data)) {
+		end = int64(len(s.data))
+	}
+
+	// Collect all in-bounds entry offsets from the index.
+	var offsets []int64
+	for idx := s.data[end:]; len(idx) >= 8; idx = idx[8:] {
+		if offset := int64(binary.BigEndian.Uint64(idx)); offset >= int64(FileSegmentHeaderSize) && offset < end {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	return &FileSegmentBestEffortIterator{
+		path:    s.path,
+		data:    s.data[:end],
+		offset:  int64(FileSegmentHeaderSize),
+		offsets: offsets,
+	}
+}
+
+// Ensure implementation implements interface.
+var _ SegmentIterator = (*FileSegmentBestEffortIterator)(nil)
+
+// FileSegmentBestEffortIterator iterates over all parseable key/value pairs
+// of a possibly damaged FileSegment.
+type FileSegmentBestEffortIterator struct {
+	path    string
+	data    []byte
+	offset  int64
+	offsets []int64 // sorted entry offsets from index
+
+	key     []byte
+	value   []byte
+	skipped []FileSegmentRegion
+}
+
+// Close releases the iterator.
+func (itr *FileSegmentBestEffortIterator) Close() error {
+	itr.data, itr.offset, itr.offsets = nil, 0, nil
+	itr.key, itr.value = nil, nil
+	return nil
+}
+
+// Key returns the current key. Must be called after Next().
+func (itr *FileSegmentBestEffortIterator) Key() []byte { return itr.key }
+
+// Value returns the current value. Must be called after Next().
+func (itr *FileSegmentBestEffortIterator) Value() []byte { return itr.value }
+
+// Entry returns the current key/value pair. Must be called after Next().
+func (itr *FileSegmentBestEffortIterator) Entry() KeyValue {
+	return KeyValue{Key: itr.key, Value: itr.value}
+}
+
+// Skipped returns the regions that could not be parsed so far.
+func (itr *FileSegmentBestEffortIterator) Skipped() []FileSegmentRegion { return itr.skipped }
+
+// Next reads the next valid key/value pair.
+func (itr *FileSegmentBestEffortIterator) Next() bool {
+	for itr.offset < int64(len(itr.data)) {
+		// Determine next known entry boundary after the current offset.
+		boundary := int64(len(itr.data))
+		if i := sort.Search(len(itr.offsets), func(i int) bool { return itr.offsets[i] > itr.offset }); i < len(itr.offsets) {
+			boundary = itr.offsets[i]
+		}
+
+		// An entry must not overlap the next entry known to the index.
+		key, value, next, ok := readFileSegmentEntry(itr.data, itr.offset)
+		if ok && next <= boundary {
+			itr.key, itr.value, itr.offset = key, value, next
+			return true
+		}
+
+		log.Warn("Skipping corrupt file segment region", "path", itr.path, "offset", itr.offset, "size", boundary-itr.offset)
+		itr.skipped = append(itr.skipped, FileSegmentRegion{Offset: itr.offset, Size: boundary - itr.offset})
+		itr.offset = boundary
+	}
+
+	itr.key, itr.value = nil, nil
+	return false
+}
+
+// readFileSegmentEntry reads the key/value pair at offset and returns the
+// offset of the next entry. Returns ok false if the entry is out of bounds.
+func readFileSegmentEntry(data []byte, offset int64) (key, value []byte, next int64, ok bool) {
+	if key, offset, ok = readFileSegmentBytes(data, offset); !ok {
+		return nil, nil, 0, false
+	} else if value, offset, ok = readFileSegmentBytes(data, offset); !ok {
+		return nil, nil, 0, false
+	}
+	return key, value, offset, true
+}
+
+// readFileSegmentBytes reads a length-prefixed byte slice at offset and returns
+// the offset immediately after it. Returns ok false if the slice is out of bounds.
+func readFileSegmentBytes(data []byte, offset int64) (b []byte, next int64, ok bool) {
+	if offset < 0 || offset >= int64(len(data)) {
+		return nil, 0, false
+	}
+
+	n, sz := binary.Uvarint(data[offset:])
+	if sz <= 0 || n > uint64(int64(len(data))-offset-int64(sz)) {
+		return nil, 0, false
+	}
+	offset += int64(sz)
+	return data[offset : offset+int64(n) : offset+int64(n)], offset + int64(n), true
+}
+
 // FileSegmentOpener initializes and opens segments.
-type FileSegmentOpener struct{}
+type FileSegmentOpener struct {
+	// Applied to each opened segment's MaxGetValueSize. Zero, the default,
+	// disables the limit so existing tables with large values stay readable.
+	MaxGetValueSize int
+}
 
 // NewFileSegmentOpener returns a new instance of FileSegmentOpener.
 func NewFileSegmentOpener() *FileSegmentOpener {
@@ -322,6 +1109,7 @@ func (o *FileSegmentOpener) OpenSegment(table, name, path string) (Segment, erro
 	switch typ {
 	case SegmentETH1:
 		segment := NewFileSegment(name, path)
+		segment.MaxGetValueSize = o.MaxGetValueSize
 		if err := segment.Open(); err != nil {
 			return nil, err
 		}
@@ -407,37 +1195,75 @@ func (c *FileSegmentCompactor) RenameSegment(ctx context.Context, dst, src strin
 
 // FileSegmentEncoder represents a encoder for building a ethdb.FileSegment.
 type FileSegmentEncoder struct {
-	f       *os.File
+	f       *os.File           // file handle, if encoding to Path
+	w       io.ReadWriteSeeker // output, either f or caller-provided
 	flushed bool
+	closed  bool
 
 	offset  int64
 	offsets []int64
+	sums    []uint64 // entry checksums, if Paranoid
 
 	// Filename of file segment to encode.
 	Path string
+
+	// If set, called periodically while encoding & during Flush(). While
+	// entries are being encoded the total is unknown so done is the number
+	// of entries written and total is -1. During Flush(), done is the number
+	// of entries indexed so far and total is the number of entries in the
+	// segment.
+	OnProgress func(done, total int64)
+
+	// Number of entries written or indexed between calls to OnProgress.
+	ProgressInterval int
+
+	// If true, the index is omitted and the segment only supports iteration.
+	// This is recorded as a zero index capacity in the header.
+	NoIndex bool
+
+	// If true, Flush() reads the finished segment back and verifies that
+	// every entry, and the index slot pointing to it, matches what was
+	// written. The entire segment is read into memory to do so, and one
+	// checksum per entry is held while encoding. This is expensive and
+	// intended for tests & development.
+	Paranoid bool
 }
 
 func NewFileSegmentEncoder(path string) *FileSegmentEncoder {
 	return &FileSegmentEncoder{
-		Path: path,
+		Path:             path,
+		ProgressInterval: DefaultFileSegmentProgressInterval,
+	}
+}
+
+// NewFileSegmentEncoderTo returns an encoder that writes to w instead of a
+// file. w must be positioned at the start of an empty stream. It is read back
+// while building the index so it must also support reads & seeks.
+func NewFileSegmentEncoderTo(w io.ReadWriteSeeker) *FileSegmentEncoder {
+	return &FileSegmentEncoder{
+		w:                w,
+		ProgressInterval: DefaultFileSegmentProgressInterval,
 	}
 }
 
 // Open opens and initializes the output file segment.
 func (enc *FileSegmentEncoder) Open() (err error) {
-	if enc.f != nil {
+	if enc.f != nil || enc.offset != 0 {
 		return errors.New("ethdb: file already open")
 	}
-	if enc.f, err = os.OpenFile(enc.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
-		return err
+	if enc.w == nil {
+		if enc.f, err = os.OpenFile(enc.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
+			return err
+		}
+		enc.w = enc.f
 	}
 
 	// Write magic & leave space for checksum & index offset.
-	if _, err := enc.f.Write([]byte(FileSegmentMagic)); err != nil {
-		enc.Close()
+	if _, err := enc.w.Write([]byte(FileSegmentMagic)); err != nil {
+		enc.Abort()
 		return err
-	} else if _, err := enc.f.Write(make([]byte, FileSegmentHeaderSize-len(FileSegmentMagic))); err != nil {
-		enc.Close()
+	} else if _, err := enc.w.Write(make([]byte, FileSegmentHeaderSize-len(FileSegmentMagic))); err != nil {
+		enc.Abort()
 		return err
 	}
 	enc.offset = int64(FileSegmentHeaderSize)
@@ -451,6 +1277,23 @@ func (enc *FileSegmentEncoder) Close() error {
 		if err := enc.f.Close(); err != nil {
 			return err
 		}
+		enc.f, enc.closed = nil, true
+	}
+	return nil
+}
+
+// Abort closes the file handle and removes the partially written file.
+// This is a no-op if the encoder was never opened, has been successfully
+// closed, or was created with NewFileSegmentEncoderTo.
+func (enc *FileSegmentEncoder) Abort() error {
+	if enc.f == nil || enc.closed {
+		return nil
+	}
+	enc.f.Close()
+	enc.f, enc.closed = nil, true
+
+	if err := os.Remove(enc.Path); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
@@ -463,15 +1306,64 @@ func (enc *FileSegmentEncoder) Flush() error {
 	enc.flushed = true
 
 	if err := enc.writeIndex(); err != nil {
-		return fmt.Errorf("ethdb: cannot write index: %s", err)
+		return fmt.Errorf("ethdb: cannot write index: %w", err)
 	} else if err := enc.writeChecksum(); err != nil {
-		return fmt.Errorf("ethdb: cannot write checksum: %s", err)
-	} else if err := enc.f.Sync(); err != nil {
+		return fmt.Errorf("ethdb: cannot write checksum: %w", err)
+	} else if err := enc.sync(); err != nil {
+		return err
+	} else if enc.Paranoid {
+		if err := enc.verify(); err != nil {
+			return fmt.Errorf("ethdb: paranoid check failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// verify reads the encoded segment back and ensures each entry matches the
+// checksum recorded when it was written and that its key is indexed at the
+// entry's offset.
+func (enc *FileSegmentEncoder) verify() error {
+	if _, err := enc.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(enc.w)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewFileSegmentFromBytes("", buf)
+	if err != nil {
 		return err
 	}
+	data := s.data[:s.IndexOffset()]
+
+	for i, offset := range enc.offsets {
+		key, value, _, ok := readFileSegmentEntry(data, offset)
+		if !ok {
+			return fmt.Errorf("entry %d out of bounds: offset=%d", i, offset)
+		} else if sum := fileSegmentEntrySum(key, value); sum != enc.sums[i] {
+			return fmt.Errorf("entry %d mismatch: offset=%d", i, offset)
+		} else if enc.NoIndex {
+			continue
+		}
+
+		if koff, _, err := s.offset(key); err != nil {
+			return err
+		} else if koff != offset {
+			return fmt.Errorf("index drift: entry %d at offset %d, indexed at %d", i, offset, koff)
+		}
+	}
 	return nil
 }
 
+// sync flushes the output to disk, if writing to a file.
+func (enc *FileSegmentEncoder) sync() error {
+	if enc.f == nil {
+		return nil
+	}
+	return enc.f.Sync()
+}
+
 // EncodeKeyValue writes framed key & value byte slices to the file and records their offset.
 func (enc *FileSegmentEncoder) EncodeKeyValue(key, value []byte) error {
 	buf := make([]byte, binary.MaxVarintLen64)
@@ -494,11 +1386,65 @@ func (enc *FileSegmentEncoder) EncodeKeyValue(key, value []byte) error {
 	}
 
 	enc.offsets = append(enc.offsets, offset)
+	if enc.Paranoid {
+		enc.sums = append(enc.sums, fileSegmentEntrySum(key, value))
+	}
+	enc.encoded()
 	return nil
 }
 
+// encoded reports encoding progress every ProgressInterval entries.
+func (enc *FileSegmentEncoder) encoded() {
+	if n := len(enc.offsets); enc.OnProgress != nil && enc.ProgressInterval > 0 && n%enc.ProgressInterval == 0 {
+		enc.OnProgress(int64(n), -1)
+	}
+}
+
+// sizeWith returns the size the finished segment would have if key & value
+// were encoded next, including the header and index.
+func (enc *FileSegmentEncoder) sizeWith(key, value []byte) int64 {
+	buf := make([]byte, binary.MaxVarintLen64)
+	sz := enc.offset
+	sz += int64(binary.PutUvarint(buf, uint64(len(key))) + len(key))
+	sz += int64(binary.PutUvarint(buf, uint64(len(value))) + len(value))
+	if !enc.NoIndex {
+		sz += int64(fileSegmentIndexCapacity(len(enc.offsets)+1)) * 8
+	}
+	return sz
+}
+
+// encodeSegment copies the data region of s to the file and records the offset of each entry.
+// Returns the number of entries in s and its smallest & largest keys.
+func (enc *FileSegmentEncoder) encodeSegment(s *FileSegment) (n int, min, max []byte, err error) {
+	if s.closed {
+		return 0, nil, nil, ErrFileSegmentClosed
+	}
+	data := s.data[:s.IndexOffset()]
+	base := enc.offset - int64(FileSegmentHeaderSize)
+
+	for offset := int64(FileSegmentHeaderSize); offset < int64(len(data)); n++ {
+		key, value, next, ok := readFileSegmentEntry(data, offset)
+		if !ok {
+			return n, nil, nil, fmt.Errorf("ethdb: invalid file segment entry: path=%s offset=%d", s.Path(), offset)
+		}
+		if n == 0 || bytes.Compare(key, min) < 0 {
+			min = key
+		}
+		if n == 0 || bytes.Compare(key, max) > 0 {
+			max = key
+		}
+		enc.offsets = append(enc.offsets, base+offset)
+		if enc.Paranoid {
+			enc.sums = append(enc.sums, fileSegmentEntrySum(key, value))
+		}
+		enc.encoded()
+		offset = next
+	}
+	return n, min, max, enc.write(data[FileSegmentHeaderSize:])
+}
+
 func (enc *FileSegmentEncoder) write(b []byte) error {
-	n, err := enc.f.Write(b)
+	n, err := enc.w.Write(b)
 	enc.offset += int64(n)
 	return err
 }
@@ -507,52 +1453,60 @@ func (enc *FileSegmentEncoder) writeIndex() error {
 	// Save offset to the start of the index.
 	indexOffset := enc.offset
 
-	// Open separate handler to reasd on-disk data.
-	f, err := os.Open(enc.Path)
-	if err != nil {
-		return err
+	if enc.NoIndex {
+		return enc.writeIndexHeader(indexOffset, 0)
 	}
-	defer f.Close()
 
-	// Build index in-memory.
-	idx := newFileSegmentEncoderIndex(f, len(enc.offsets))
-	for _, offset := range enc.offsets {
+	// Build index in-memory by reading keys back from the output.
+	idx := newFileSegmentEncoderIndex(enc.w, len(enc.offsets))
+	for i, offset := range enc.offsets {
 		if err := idx.insert(offset); err != nil {
 			return err
 		}
+		if enc.OnProgress != nil && enc.ProgressInterval > 0 && (i+1)%enc.ProgressInterval == 0 {
+			enc.OnProgress(int64(i+1), int64(len(enc.offsets)))
+		}
+	}
+	if enc.OnProgress != nil {
+		enc.OnProgress(int64(len(enc.offsets)), int64(len(enc.offsets)))
 	}
 
-	// Encode index to writer.
-	if _, err := idx.WriteTo(enc.f); err != nil {
+	// Encode index to writer after the data.
+	if _, err := enc.w.Seek(indexOffset, io.SeekStart); err != nil {
+		return err
+	} else if _, err := idx.WriteTo(enc.w); err != nil {
 		return err
 	}
+	return enc.writeIndexHeader(indexOffset, idx.capacity())
+}
 
-	// Write length, capacity & index offset to the header.
+// writeIndexHeader writes length, capacity & index offset to the header.
+func (enc *FileSegmentEncoder) writeIndexHeader(indexOffset int64, capacity int) error {
 	hdr := make([]byte, FileSegmentIndexOffsetSize+FileSegmentIndexCountSize+FileSegmentIndexCapacitySize)
 	binary.BigEndian.PutUint64(hdr[0:8], uint64(indexOffset))
 	binary.BigEndian.PutUint64(hdr[8:16], uint64(len(enc.offsets)))
-	binary.BigEndian.PutUint64(hdr[16:24], uint64(idx.capacity()))
-	if _, err := enc.f.Seek(int64(len(FileSegmentMagic)+FileSegmentChecksumSize), io.SeekStart); err != nil {
+	binary.BigEndian.PutUint64(hdr[16:24], uint64(capacity))
+	if _, err := enc.w.Seek(int64(len(FileSegmentMagic)+FileSegmentChecksumSize), io.SeekStart); err != nil {
 		return err
-	} else if _, err := enc.f.Write(hdr); err != nil {
+	} else if _, err := enc.w.Write(hdr); err != nil {
 		return err
-	} else if err := enc.f.Sync(); err != nil {
+	} else if err := enc.sync(); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (enc *FileSegmentEncoder) writeChecksum() error {
-	buf, err := ChecksumFileSegment(enc.Path)
+	buf, err := checksumFileSegment(enc.w)
 	if err != nil {
 		return err
 	}
 
-	if _, err := enc.f.Seek(int64(len(FileSegmentMagic)), io.SeekStart); err != nil {
+	if _, err := enc.w.Seek(int64(len(FileSegmentMagic)), io.SeekStart); err != nil {
 		return err
-	} else if _, err := enc.f.Write(buf); err != nil {
+	} else if _, err := enc.w.Write(buf); err != nil {
 		return err
-	} else if err := enc.f.Sync(); err != nil {
+	} else if err := enc.sync(); err != nil {
 		return err
 	}
 	return nil
@@ -567,11 +1521,16 @@ func ChecksumFileSegment(path string) ([]byte, error) {
 	}
 	defer f.Close()
 
+	return checksumFileSegment(f)
+}
+
+// checksumFileSegment calculates the checksum for the file segment in r.
+func checksumFileSegment(r io.ReadSeeker) ([]byte, error) {
 	// Compute checksum for all data after checksum.
 	h := xxhash.New()
-	if _, err := f.Seek(int64(len(FileSegmentMagic)+FileSegmentChecksumSize), io.SeekStart); err != nil {
+	if _, err := r.Seek(int64(len(FileSegmentMagic)+FileSegmentChecksumSize), io.SeekStart); err != nil {
 		return nil, err
-	} else if _, err := io.Copy(h, f); err != nil {
+	} else if _, err := io.Copy(h, r); err != nil {
 		return nil, err
 	}
 
@@ -600,6 +1559,289 @@ func VerifyFileSegment(path string) error {
 	return nil
 }
 
+// FileSegmentFootprint returns the memory used by the metadata of the file
+// segment at path once opened. Only the header is read. The index is mapped
+// rather than copied, so indexBytes is the size of the index that is paged
+// in during lookups. File segments have no bloom filter so bloomBytes is
+// always zero.
+func FileSegmentFootprint(path string) (indexBytes, bloomBytes int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, FileSegmentHeaderSize)
+	n, _ := io.ReadFull(f, hdr)
+	if err := checkFileSegmentMagic(hdr[:n]); err != nil {
+		return 0, 0, err
+	}
+
+	s := &FileSegment{data: hdr}
+	return int64(s.Cap()) * 8, 0, nil
+}
+
+// ReindexFileSegment rebuilds the index, count & checksum of the file segment
+// at path from its data region. Entries are length-prefixed so the data region
+// can be scanned without the index. The header's index offset is used to find
+// the end of the data region and must be intact.
+//
+// The rebuilt segment is written to a temporary file and then renamed over path.
+func ReindexFileSegment(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	} else if err := checkFileSegmentMagic(buf); err != nil {
+		return err
+	}
+
+	end := (&FileSegment{data: buf}).IndexOffset()
+	if end < int64(FileSegmentHeaderSize) || end > int64(len(buf)) {
+		return fmt.Errorf("%w: index offset out of bounds: %d", ErrFileSegmentCorrupt, end)
+	}
+	data := buf[:end]
+
+	tmpPath := path + ".tmp"
+	enc := NewFileSegmentEncoder(tmpPath)
+	if err := enc.Open(); err != nil {
+		return err
+	}
+	defer enc.Abort()
+
+	for offset := int64(FileSegmentHeaderSize); offset < end; {
+		key, value, next, ok := readFileSegmentEntry(data, offset)
+		if !ok {
+			return fmt.Errorf("%w: invalid entry at offset %d", ErrFileSegmentCorrupt, offset)
+		} else if err := enc.EncodeKeyValue(key, value); err != nil {
+			return err
+		}
+		offset = next
+	}
+
+	if err := enc.Flush(); err != nil {
+		return err
+	} else if err := enc.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// BuildSegmentFromIterator writes all entries from itr to a new file segment
+// at path and returns the number of entries written. Keys must be strictly
+// ascending or ErrFileSegmentUnsorted is returned.
+//
+// Iterators over a prefixed table return keys that include the prefix. If
+// prefix is non-empty then every key must begin with it and it is stripped
+// before the key is written. Stripping a shared prefix does not change order.
+//
+// itr is always closed before returning, whether or not the build succeeds.
+func BuildSegmentFromIterator(path string, itr SegmentIterator, prefix []byte) (n int, err error) {
+	closed := false
+	defer func() {
+		if !closed {
+			itr.Close()
+		}
+	}()
+
+	enc := NewFileSegmentEncoder(path)
+	if err := enc.Open(); err != nil {
+		return 0, err
+	}
+	defer enc.Abort()
+
+	var prev []byte
+	for ; itr.Next(); n++ {
+		key := itr.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			return n, fmt.Errorf("ethdb: key missing prefix %x: %x", prefix, key)
+		}
+		key = key[len(prefix):]
+
+		if n > 0 && bytes.Compare(key, prev) <= 0 {
+			return n, ErrFileSegmentUnsorted
+		} else if err := enc.EncodeKeyValue(key, itr.Value()); err != nil {
+			return n, err
+		}
+		prev = append(prev[:0], key...)
+	}
+	closed = true
+	if err := itr.Close(); err != nil {
+		return n, err
+	}
+
+	if err := enc.Flush(); err != nil {
+		return n, err
+	} else if err := enc.Close(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// OpenAndVerify opens the file segment at path and ensures both its stored
+// checksum and its computed checksum equal expected. This lets a receiver
+// verify a copied segment against the sender's Checksum() in a single pass.
+func OpenAndVerify(path string, expected []byte) (*FileSegment, error) {
+	s := NewFileSegment(filepath.Base(path), path)
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+
+	computed := make([]byte, FileSegmentChecksumSize)
+	binary.BigEndian.PutUint64(computed, xxhash.Sum64(s.data[len(FileSegmentMagic)+FileSegmentChecksumSize:]))
+	if !bytes.Equal(s.Checksum(), expected) || !bytes.Equal(computed, expected) {
+		s.Close()
+		return nil, ErrFileSegmentChecksumMismatch
+	}
+	return s, nil
+}
+
+// ConcatFileSegments writes a new file segment to dst which contains the
+// entries of all srcs, in order. The data regions are copied as-is and only
+// the index & header are rebuilt so this is much faster than reencoding.
+//
+// The key ranges of srcs must be disjoint and ascending. That is, the smallest
+// key of each segment must sort after the largest key of the previous segments,
+// otherwise ErrFileSegmentRangeOverlap is returned. Entries within a segment
+// may be in any order. Returns ErrFileSegmentClosed if any src is closed.
+func ConcatFileSegments(dst string, srcs []*FileSegment) error {
+	enc := NewFileSegmentEncoder(dst)
+	if err := enc.Open(); err != nil {
+		return err
+	}
+	defer enc.Abort()
+
+	var prevMax []byte
+	var hasPrev bool
+	for _, s := range srcs {
+		n, min, max, err := enc.encodeSegment(s)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			continue
+		} else if hasPrev && bytes.Compare(min, prevMax) <= 0 {
+			return ErrFileSegmentRangeOverlap
+		}
+		prevMax, hasPrev = max, true
+	}
+
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// EqualFileSegments returns true if a & b contain the same key/value pairs in
+// the same iteration order.
+func EqualFileSegments(a, b *FileSegment) (bool, error) {
+	key, err := CompareFileSegments(a, b)
+	if err != nil {
+		return false, err
+	}
+	return key == nil, nil
+}
+
+// CompareFileSegments iterates over a & b and returns the first key where the
+// segments differ. Returns a nil key if the segments are equal.
+func CompareFileSegments(a, b *FileSegment) ([]byte, error) {
+	aitr, bitr := a.Iterator(), b.Iterator()
+	defer aitr.Close()
+	defer bitr.Close()
+
+	for {
+		// An iterator stopped by an error must not read as the end of its segment.
+		aok, bok := aitr.Next(), bitr.Next()
+		if !aok {
+			if err := aitr.Close(); err != nil {
+				return nil, err
+			}
+		}
+		if !bok {
+			if err := bitr.Close(); err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case !aok && !bok:
+			return nil, nil
+		case !aok:
+			return common.CopyBytes(bitr.Key()), nil
+		case !bok:
+			return common.CopyBytes(aitr.Key()), nil
+		case !bytes.Equal(aitr.Key(), bitr.Key()):
+			if bytes.Compare(aitr.Key(), bitr.Key()) < 0 {
+				return common.CopyBytes(aitr.Key()), nil
+			}
+			return common.CopyBytes(bitr.Key()), nil
+		case !bytes.Equal(aitr.Value(), bitr.Value()):
+			return common.CopyBytes(aitr.Key()), nil
+		}
+	}
+}
+
+// FileSegmentDiffOp represents the kind of change reported by DiffFileSegments.
+type FileSegmentDiffOp int
+
+const (
+	FileSegmentDiffAdded   FileSegmentDiffOp = iota + 1 // key only in b
+	FileSegmentDiffChanged                              // key in both, values differ
+	FileSegmentDiffRemoved                              // key only in a
+)
+
+// DiffFileSegments calls fn for each key that differs between a and b. The
+// value passed to fn is from b for added & changed keys and from a for
+// removed keys. Slices passed to fn are only valid during the call.
+//
+// Each segment is iterated once and keys are looked up in the other
+// segment's index so neither segment is loaded into memory and neither
+// needs to be sorted. Both segments must be indexed. Returns
+// ErrFileSegmentClosed if either segment is closed.
+func DiffFileSegments(a, b *FileSegment, fn func(op FileSegmentDiffOp, key, value []byte) error) error {
+	if a.closed || b.closed {
+		return ErrFileSegmentClosed
+	} else if !a.Indexed() || !b.Indexed() {
+		return ErrFileSegmentNoIndex
+	}
+
+	// Report keys added to or changed in b.
+	bitr := b.Iterator()
+	defer bitr.Close()
+	for bitr.Next() {
+		av, err := a.lookup(bitr.Key(), false)
+		if err == common.ErrNotFound {
+			if err := fn(FileSegmentDiffAdded, bitr.Key(), bitr.Value()); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(av, bitr.Value()) {
+			if err := fn(FileSegmentDiffChanged, bitr.Key(), bitr.Value()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bitr.Close(); err != nil {
+		return err
+	}
+
+	// Report keys removed from b.
+	aitr := a.Iterator()
+	defer aitr.Close()
+	for aitr.Next() {
+		if koff, _, err := b.offset(aitr.Key()); err != nil {
+			return err
+		} else if koff == 0 {
+			if err := fn(FileSegmentDiffRemoved, aitr.Key(), aitr.Value()); err != nil {
+				return err
+			}
+		}
+	}
+	return aitr.Close()
+}
+
 // fileSegmentEncoderIndex represents a fixed-length RHH-based hash map.
 // The map does not support insertion of duplicate keys.
 //
@@ -618,16 +1860,20 @@ func newFileSegmentEncoderIndex(src io.ReadSeeker, n int) *fileSegmentEncoderInd
 		r:   bufio.NewReader(src),
 	}
 
-	// Determine maximum capacity by padding length and finding next power of 2.
-	const loadFactor = 90
-	capacity := pow2(uint64((n * 100) / loadFactor))
-
+	capacity := fileSegmentIndexCapacity(n)
 	idx.elems = make([]int64, capacity)
 	idx.mask = uint64(capacity - 1)
 
 	return idx
 }
 
+// fileSegmentIndexCapacity returns the index capacity for n entries.
+func fileSegmentIndexCapacity(n int) uint64 {
+	// Determine maximum capacity by padding length and finding next power of 2.
+	const loadFactor = 90
+	return pow2(uint64((n * 100) / loadFactor))
+}
+
 // WriteTo writes the index to w. Implements io.WriterTo.
 func (idx *fileSegmentEncoderIndex) WriteTo(w io.Writer) (n int64, err error) {
 	buf := make([]byte, 8)
@@ -672,7 +1918,7 @@ func (idx *fileSegmentEncoderIndex) insert(offset int64) error {
 
 		// Return an error if a duplicate key exists.
 		if bytes.Equal(curr, key) {
-			return errors.New("ethdb: duplicate key written to file segment")
+			return ErrFileSegmentDuplicateKey
 		}
 
 		// Swap if current element has a lower probe distance.
@@ -712,6 +1958,16 @@ func (idx *fileSegmentEncoderIndex) readAt(offset int64) ([]byte, error) {
 	return key, nil
 }
 
+// fileSegmentEntrySum returns a checksum of an entry's key & value.
+func fileSegmentEntrySum(key, value []byte) uint64 {
+	h := xxhash.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+	h.Write(buf[:binary.PutUvarint(buf, uint64(len(key)))])
+	h.Write(key)
+	h.Write(value)
+	return h.Sum64()
+}
+
 func hashKey(key []byte) uint64 {
 	h := xxhash.Sum64(key)
 	if h == 0 {
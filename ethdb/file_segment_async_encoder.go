@@ -0,0 +1,106 @@
+package ethdb
+
+import (
+	"errors"
+	"sync"
+)
+
+// AsyncFileSegmentEncoder accepts key/value pairs from a producer and writes
+// them to a FileSegmentEncoder on a background goroutine. Pairs are queued
+// in a bounded buffer so EncodeKeyValue() blocks once the writer falls behind.
+type AsyncFileSegmentEncoder struct {
+	enc    *FileSegmentEncoder
+	ch     chan KeyValue
+	done   chan struct{} // closed when the writer goroutine exits
+	failed chan struct{} // closed when the writer encounters an error
+	closed bool
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewAsyncFileSegmentEncoder returns a new instance of AsyncFileSegmentEncoder
+// that writes to enc, which must already be open. Up to n pairs are buffered
+// before EncodeKeyValue() blocks.
+func NewAsyncFileSegmentEncoder(enc *FileSegmentEncoder, n int) *AsyncFileSegmentEncoder {
+	e := &AsyncFileSegmentEncoder{
+		enc:    enc,
+		ch:     make(chan KeyValue, n),
+		done:   make(chan struct{}),
+		failed: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *AsyncFileSegmentEncoder) run() {
+	defer close(e.done)
+	for kv := range e.ch {
+		if err := e.enc.EncodeKeyValue(kv.Key, kv.Value); err != nil {
+			e.fail(err)
+			return
+		}
+	}
+}
+
+func (e *AsyncFileSegmentEncoder) fail(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+		close(e.failed)
+	}
+}
+
+// Err returns the first error encountered by the writer, if any.
+func (e *AsyncFileSegmentEncoder) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// EncodeKeyValue queues a copy of key & value to be written. Blocks while the
+// buffer is full. Returns the writer's error once it has failed.
+func (e *AsyncFileSegmentEncoder) EncodeKeyValue(key, value []byte) error {
+	if e.closed {
+		return errors.New("ethdb: async encoder closed")
+	}
+
+	kv := KeyValue{
+		Key:   append([]byte{}, key...),
+		Value: append([]byte{}, value...),
+	}
+	select {
+	case <-e.failed:
+		return e.Err()
+	default:
+	}
+	select {
+	case e.ch <- kv:
+		return nil
+	case <-e.failed:
+		return e.Err()
+	}
+}
+
+// Close waits for all queued pairs to be written, then flushes & closes the
+// underlying encoder. If any write failed, the encoder is aborted and the
+// first error is returned.
+func (e *AsyncFileSegmentEncoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	close(e.ch)
+	<-e.done
+
+	if err := e.Err(); err != nil {
+		e.enc.Abort()
+		return err
+	} else if err := e.enc.Flush(); err != nil {
+		e.enc.Abort()
+		return err
+	}
+	return e.enc.Close()
+}
@@ -0,0 +1,83 @@
+package ethdb_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+func TestAsyncFileSegmentEncoder(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		path := MustTempFile()
+		defer os.Remove(path)
+
+		enc := ethdb.NewFileSegmentEncoder(path)
+		if err := enc.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reuse the same buffer to ensure pairs are copied before queueing.
+		aenc := ethdb.NewAsyncFileSegmentEncoder(enc, 4)
+		buf := make([]byte, 4)
+		for i := 0; i < 1000; i++ {
+			copy(buf, fmt.Sprintf("%04d", i))
+			if err := aenc.EncodeKeyValue(buf, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := aenc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if n := s.Len(); n != 1000 {
+			t.Fatalf("unexpected len: %d", n)
+		} else if v, err := s.Get([]byte("0123")); err != nil {
+			t.Fatal(err)
+		} else if string(v) != "0123" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+	})
+
+	t.Run("ErrWrite", func(t *testing.T) {
+		w := &FailingSeekableBuffer{}
+		enc := ethdb.NewFileSegmentEncoderTo(w)
+		if err := enc.Open(); err != nil {
+			t.Fatal(err)
+		}
+		w.Err = errors.New("marker")
+
+		// Error must reach the producer before it writes everything.
+		aenc := ethdb.NewAsyncFileSegmentEncoder(enc, 1)
+		var err error
+		for i := 0; i < 1000 && err == nil; i++ {
+			err = aenc.EncodeKeyValue([]byte("key"), []byte("value"))
+		}
+		if err != w.Err {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := aenc.Close(); err != w.Err {
+			t.Fatalf("unexpected close error: %v", err)
+		}
+	})
+}
+
+// FailingSeekableBuffer is a SeekableBuffer whose writes return Err, if set.
+type FailingSeekableBuffer struct {
+	SeekableBuffer
+	Err error
+}
+
+func (b *FailingSeekableBuffer) Write(p []byte) (int, error) {
+	if b.Err != nil {
+		return 0, b.Err
+	}
+	return b.SeekableBuffer.Write(p)
+}
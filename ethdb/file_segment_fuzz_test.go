@@ -0,0 +1,72 @@
+//go:build go1.18
+// +build go1.18
+
+package ethdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+// Ensure ethdb.FileSegment returns errors instead of panicking on arbitrary input.
+func FuzzFileSegmentGet(f *testing.F) {
+	// Seed corpus with valid segments.
+	for _, n := range []int{0, 1, 10, 100} {
+		keys, values := make([][]byte, n), make([][]byte, n)
+		for i := range keys {
+			keys[i], values[i] = []byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte{byte(i)}, i)
+		}
+
+		path := MustTempFile()
+		if err := EncodeToFileSegment(path, keys, values); err != nil {
+			f.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		os.Remove(path)
+		f.Add(buf)
+	}
+	f.Add([]byte{})
+	f.Add([]byte(ethdb.FileSegmentMagic))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Corrupt indexes can make lookups linear so keep inputs small.
+		if len(data) > 1<<16 {
+			return
+		}
+
+		path := filepath.Join(t.TempDir(), "segment")
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); err != nil {
+			return
+		}
+		defer s.Close()
+
+		s.Get([]byte("key0"))
+		s.Has([]byte("key1"))
+
+		// Iterate and fetch the first keys.
+		itr := s.Iterator()
+		for i := 0; itr.Next() && i < 100; i++ {
+			s.Get(itr.Key())
+		}
+		itr.Close()
+
+		bitr := s.BestEffortIterator()
+		for bitr.Next() {
+		}
+		bitr.Close()
+	})
+}
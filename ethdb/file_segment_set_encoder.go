@@ -0,0 +1,159 @@
+package ethdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileSegmentSetManifest is the name of the file listing the segments
+// written by a FileSegmentSetEncoder. It has an extension so
+// FileSegmentOpener.ListSegmentNames() does not list it as a segment.
+const FileSegmentSetManifest = "MANIFEST.txt"
+
+// FileSegmentSetEncoder encodes a sorted stream of key/value pairs into a
+// directory of file segments. A new segment is started before a pair that
+// would grow the current segment, including its header & index, past
+// MaxBytes so segment boundaries always fall between keys.
+type FileSegmentSetEncoder struct {
+	enc        *FileSegmentEncoder
+	names      []string
+	lastKey    []byte
+	hasLastKey bool // false until the first pair, as lastKey may be empty
+
+	// Directory to write segments & manifest to.
+	Dir string
+
+	// Maximum size, in bytes, of each segment file. A segment holding a
+	// single key/value pair may exceed this size.
+	MaxBytes int64
+}
+
+// NewFileSegmentSetEncoder returns a new instance of FileSegmentSetEncoder.
+func NewFileSegmentSetEncoder(dir string, maxBytes int64) *FileSegmentSetEncoder {
+	return &FileSegmentSetEncoder{Dir: dir, MaxBytes: maxBytes}
+}
+
+// Names returns the names of all segments started so far.
+func (e *FileSegmentSetEncoder) Names() []string { return e.names }
+
+// EncodeKeyValue writes key & value to the current segment. Keys must be
+// strictly increasing across calls.
+func (e *FileSegmentSetEncoder) EncodeKeyValue(key, value []byte) error {
+	if e.hasLastKey && bytes.Compare(key, e.lastKey) <= 0 {
+		return ErrFileSegmentUnsorted
+	}
+
+	// Finalize current segment if this pair would grow it past its maximum size.
+	if e.enc != nil && len(e.enc.offsets) > 0 && e.enc.sizeWith(key, value) > e.MaxBytes {
+		if err := e.finish(); err != nil {
+			return err
+		}
+	}
+
+	// Start a new segment if one is not in progress.
+	if e.enc == nil {
+		if err := os.MkdirAll(e.Dir, 0777); err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%08d", len(e.names))
+		enc := NewFileSegmentEncoder(filepath.Join(e.Dir, name))
+		if err := enc.Open(); err != nil {
+			return err
+		}
+		e.enc, e.names = enc, append(e.names, name)
+	}
+
+	if err := e.enc.EncodeKeyValue(key, value); err != nil {
+		return err
+	}
+	e.lastKey, e.hasLastKey = append(e.lastKey[:0], key...), true
+	return nil
+}
+
+// Close finalizes the current segment and writes the manifest.
+func (e *FileSegmentSetEncoder) Close() error {
+	if e.enc != nil {
+		if err := e.finish(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, name := range e.names {
+		fmt.Fprintln(&buf, name)
+	}
+	if err := os.MkdirAll(e.Dir, 0777); err != nil {
+		return err
+	}
+	return e.writeManifest(buf.Bytes())
+}
+
+// writeManifest writes the manifest to a temporary file and renames it into
+// place so a crash never leaves a truncated manifest.
+func (e *FileSegmentSetEncoder) writeManifest(b []byte) error {
+	path := filepath.Join(e.Dir, FileSegmentSetManifest)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Abort removes the segment currently being written. Finalized segments are left in place.
+func (e *FileSegmentSetEncoder) Abort() error {
+	if e.enc == nil {
+		return nil
+	}
+	err := e.enc.Abort()
+	e.enc = nil
+	return err
+}
+
+func (e *FileSegmentSetEncoder) finish() error {
+	if err := e.enc.Flush(); err != nil {
+		return err
+	} else if err := e.enc.Close(); err != nil {
+		return err
+	}
+	e.enc = nil
+	return nil
+}
+
+// OpenFileSegmentSet returns a segment set containing every file segment
+// listed in the manifest in dir. Segments are opened lazily by the set.
+func OpenFileSegmentSet(dir string, maxOpenCount int) (*SegmentSet, error) {
+	f, err := os.Open(filepath.Join(dir, FileSegmentSetManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ss := NewSegmentSet(maxOpenCount)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		ss.Add(NewFileSegment(name, filepath.Join(dir, name)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
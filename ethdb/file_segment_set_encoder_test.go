@@ -0,0 +1,91 @@
+package ethdb_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+func TestFileSegmentSetEncoder(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	// Encode 100 entries of ~100 bytes into segments capped at 1KB.
+	const n = 100
+	enc := ethdb.NewFileSegmentSetEncoder(dir, 1024)
+	for i := 0; i < n; i++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := enc.EncodeKeyValue(key, make([]byte, 90)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.EncodeKeyValue([]byte{0}, nil); err != ethdb.ErrFileSegmentUnsorted {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure each file, including header & index, is within the limit.
+	for _, name := range enc.Names() {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() > 1024 {
+			t.Fatalf("segment %s exceeds max size: %d bytes", name, fi.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ethdb.FileSegmentSetManifest+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary manifest removed: %v", err)
+	}
+
+	// Ensure the manifest is not listed if dir is used as a table path.
+	if names, err := ethdb.NewFileSegmentOpener().ListSegmentNames(dir, "tbl"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, enc.Names()) {
+		t.Fatalf("unexpected segment names: %v", names)
+	}
+
+	ss, err := ethdb.OpenFileSegmentSet(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	if ss.Len() != len(enc.Names()) {
+		t.Fatalf("unexpected segment count: %d", ss.Len())
+	} else if ss.Len() < 2 {
+		t.Fatalf("expected multiple segments, got %d", ss.Len())
+	}
+
+	// Ensure every key is readable and in order.
+	itr := ethdb.NewSegmentDatabase(ss).NewIterator(nil, nil)
+	var i uint64
+	for ; itr.Next(); i++ {
+		if v := binary.BigEndian.Uint64(itr.Key()); v != i {
+			t.Fatalf("unexpected key: %d, expected %d", v, i)
+		}
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatal(err)
+	} else if i != n {
+		t.Fatalf("unexpected key count: %d", i)
+	}
+}
+
+// Ensure an empty first key still requires later keys to sort after it.
+func TestFileSegmentSetEncoder_EmptyKey(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	enc := ethdb.NewFileSegmentSetEncoder(dir, 1024)
+	defer enc.Abort()
+	if err := enc.EncodeKeyValue([]byte{}, nil); err != nil {
+		t.Fatal(err)
+	} else if err := enc.EncodeKeyValue([]byte{}, nil); err != ethdb.ErrFileSegmentUnsorted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -3,24 +3,1278 @@ package ethdb_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/bcskill/bcschain/v3/common"
+	"github.com/cespare/xxhash"
 
 	"github.com/bcskill/bcschain/v3/ethdb"
 )
 
+var paranoid = flag.Bool("ethdb.paranoid", false, "verify every encoded file segment entry after indexing")
+
 func TestFileSegment_Get(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		path := MustTempFile()
 		defer os.Remove(path)
 
-		// Encode key/values to file segment.
+		// Encode key/values to file segment.
+		enc := ethdb.NewFileSegmentEncoder(path)
+		if err := enc.Open(); err != nil {
+			t.Fatal(err)
+		} else if err := enc.EncodeKeyValue([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		} else if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Open as file segment.
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// Fetch existing keys.
+		if v, err := s.Get([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+
+		// Fetch unknown key.
+		if v, err := s.Get([]byte("no_such_key")); err != common.ErrNotFound {
+			t.Fatalf("unexpected error: %s", err)
+		} else if v != nil {
+			t.Fatalf("expected nil value, got %q", v)
+		}
+
+		// Close file segment.
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestFileSegment_Layout(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("foo")}, [][]byte{[]byte("bar")})
+	defer s.Close()
+
+	// Entry is 8 bytes & the index has a capacity of 2.
+	if layout := s.Layout(); !reflect.DeepEqual(layout, ethdb.FileSegmentLayout{
+		Header: ethdb.FileSegmentRegion{Offset: 0, Size: 36},
+		Data:   ethdb.FileSegmentRegion{Offset: 36, Size: 8},
+		Index:  ethdb.FileSegmentRegion{Offset: 44, Size: 16},
+	}) {
+		t.Fatalf("unexpected layout: %+v", layout)
+	}
+}
+
+func TestFileSegment_LockIndex(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock failures are only logged so Open() should always succeed.
+	s := ethdb.NewFileSegment("test", path)
+	s.LockIndex = true
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.Get([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "bar" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSegment_HasBatch(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("c")}, [][]byte{[]byte("1"), []byte("2")})
+	defer s.Close()
+
+	if a, err := s.HasBatch([][]byte{[]byte("c"), []byte("b"), []byte("a"), []byte("d")}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []bool{true, false, true, false}) {
+		t.Fatalf("unexpected results: %v", a)
+	}
+}
+
+// Ensure lookups do not allocate beyond the copy of the returned value.
+func TestFileSegment_Allocs(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	s := MustOpenFileSegment(keys, keys)
+	defer s.Close()
+
+	key, buf := []byte("b"), make([]byte, 0, 16)
+	if n := testing.AllocsPerRun(100, func() { s.Has(key) }); n != 0 {
+		t.Fatalf("Has: unexpected allocs: %v", n)
+	} else if n := testing.AllocsPerRun(100, func() { s.AppendValue(buf[:0], key) }); n != 0 {
+		t.Fatalf("AppendValue: unexpected allocs: %v", n)
+	} else if n := testing.AllocsPerRun(100, func() { s.Get(key) }); n != 1 {
+		t.Fatalf("Get: unexpected allocs: %v", n)
+	}
+
+	if v, err := s.AppendValue([]byte("x"), key); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "xb" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+func TestNewFileSegmentFromBytes(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ethdb.NewFileSegmentFromBytes("test", buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if v, err := s.Get([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "bar" {
+		t.Fatalf("unexpected value: %q", v)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ethdb.NewFileSegmentFromBytes("test", buf[:8]); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNewFileSegmentEncoderTo(t *testing.T) {
+	var buf SeekableBuffer
+	enc := ethdb.NewFileSegmentEncoderTo(&buf)
+	if err := enc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := enc.EncodeKeyValue([]byte(key), []byte(key+"v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure output matches the same segment encoded to a file.
+	path := MustTempFile()
+	defer os.Remove(path)
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, [][]byte{[]byte("av"), []byte("bv"), []byte("cv")}); err != nil {
+		t.Fatal(err)
+	} else if exp, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), exp) {
+		t.Fatal("unexpected segment bytes")
+	}
+
+	s, err := ethdb.NewFileSegmentFromBytes("test", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	} else if v, err := s.Get([]byte("b")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "bv" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+func TestFileSegment_MaxGetValueSize(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a")}, [][]byte{make([]byte, 100)})
+	defer s.Close()
+
+	s.MaxGetValueSize = 99
+	if _, err := s.Get([]byte("a")); err != ethdb.ErrFileSegmentValueTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	} else if v, err := s.AppendValue(nil, []byte("a")); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 100 {
+		t.Fatalf("unexpected value length: %d", len(v))
+	}
+
+	s.MaxGetValueSize = 100
+	if v, err := s.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 100 {
+		t.Fatalf("unexpected value length: %d", len(v))
+	}
+
+	// Ensure the limit only applies to Get.
+	s.MaxGetValueSize = 99
+	if err := s.SelfCheck(); err != nil {
+		t.Fatal(err)
+	} else if v := s.GetOrDefault([]byte("a"), nil); len(v) != 100 {
+		t.Fatalf("unexpected value length: %d", len(v))
+	}
+}
+
+// Ensure segments opened for a table do not limit Get by default.
+func TestFileSegmentOpener_MaxGetValueSize(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("a")}, [][]byte{[]byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{0, 99} {
+		o := ethdb.NewFileSegmentOpener()
+		o.MaxGetValueSize = limit
+		s, err := o.OpenSegment("tbl", "test", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := s.(*ethdb.FileSegment).MaxGetValueSize; n != limit {
+			t.Fatalf("unexpected limit: %d", n)
+		}
+		s.Close()
+	}
+}
+
+func TestFilterIterator(t *testing.T) {
+	keys := [][]byte{[]byte("a1"), []byte("b1"), []byte("a2"), []byte("b2")}
+	s := MustOpenFileSegment(keys, keys)
+	defer s.Close()
+
+	itr := ethdb.FilterIterator(s.Iterator(), func(key, value []byte) bool {
+		return bytes.HasPrefix(key, []byte("b"))
+	})
+	var a []string
+	for itr.Next() {
+		a = append(a, string(itr.Key()))
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []string{"b1", "b2"}) {
+		t.Fatalf("unexpected keys: %v", a)
+	}
+}
+
+func TestFileSegmentFootprint(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if err := EncodeToFileSegment(path, keys, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if indexBytes, bloomBytes, err := ethdb.FileSegmentFootprint(path); err != nil {
+		t.Fatal(err)
+	} else if indexBytes != int64(len(s.Index())) {
+		t.Fatalf("unexpected index bytes: %d", indexBytes)
+	} else if bloomBytes != 0 {
+		t.Fatalf("unexpected bloom bytes: %d", bloomBytes)
+	}
+}
+
+// Ensure binary keys round-trip exactly, including bytes that match framing
+// or header values.
+func TestFileSegment_BinaryKeys(t *testing.T) {
+	keys := [][]byte{
+		{0x00},
+		{0xFF},
+		{0x00, 0x00, 0x00},
+		{0xFF, 0x00, 0xFF},
+		[]byte(ethdb.FileSegmentMagic),
+		append([]byte(ethdb.FileSegmentMagic), 0x00),
+		{0x80, 0x80, 0x80, 0x01}, // uvarint continuation bytes
+		bytes.Repeat([]byte{0x00}, 300),
+	}
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		values[i] = append([]byte{byte(i)}, keys[i]...)
+	}
+
+	s := MustOpenFileSegment(keys, values)
+	defer s.Close()
+
+	for i := range keys {
+		if v, err := s.Get(keys[i]); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(v, values[i]) {
+			t.Fatalf("Get(%x)=%x, expected %x", keys[i], v, values[i])
+		}
+	}
+
+	itr := s.Iterator()
+	defer itr.Close()
+	for i := range keys {
+		if !itr.Next() {
+			t.Fatalf("expected entry %d", i)
+		} else if !bytes.Equal(itr.Key(), keys[i]) || !bytes.Equal(itr.Value(), values[i]) {
+			t.Fatalf("unexpected entry %d: key=%x value=%x", i, itr.Key(), itr.Value())
+		}
+	}
+	if itr.Next() {
+		t.Fatal("expected end of iterator")
+	}
+}
+
+func TestBuildSegmentFromIterator(t *testing.T) {
+	t.Run("Prefix", func(t *testing.T) {
+		src := MustOpenFileSegment([][]byte{[]byte("pa"), []byte("pb")}, [][]byte{[]byte("1"), []byte("2")})
+		defer src.Close()
+
+		path := MustTempFile()
+		defer os.Remove(path)
+		if n, err := ethdb.BuildSegmentFromIterator(path, src.Iterator(), []byte("p")); err != nil {
+			t.Fatal(err)
+		} else if n != 2 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if v, err := s.Get([]byte("b")); err != nil {
+			t.Fatal(err)
+		} else if string(v) != "2" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+	})
+
+	t.Run("ErrUnsorted", func(t *testing.T) {
+		src := MustOpenFileSegment([][]byte{[]byte("b"), []byte("a")}, [][]byte{nil, nil})
+		defer src.Close()
+
+		path := MustTempFile()
+		defer os.Remove(path)
+		itr := &ClosedFlagIterator{SegmentIterator: src.Iterator()}
+		if _, err := ethdb.BuildSegmentFromIterator(path, itr, nil); err != ethdb.ErrFileSegmentUnsorted {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatal("expected partial segment to be removed")
+		} else if !itr.Closed {
+			t.Fatal("expected iterator to be closed")
+		}
+	})
+}
+
+// ClosedFlagIterator wraps a SegmentIterator and records whether it was closed.
+type ClosedFlagIterator struct {
+	ethdb.SegmentIterator
+	Closed bool
+}
+
+func (itr *ClosedFlagIterator) Close() error {
+	itr.Closed = true
+	return itr.SegmentIterator.Close()
+}
+
+func TestDiffFileSegments(t *testing.T) {
+	a := MustOpenFileSegment(
+		[][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		[][]byte{[]byte("1"), []byte("2"), []byte("3")},
+	)
+	defer a.Close()
+	b := MustOpenFileSegment(
+		[][]byte{[]byte("d"), []byte("c"), []byte("a")},
+		[][]byte{[]byte("4"), []byte("3"), []byte("x")},
+	)
+	defer b.Close()
+
+	var diffs []string
+	if err := ethdb.DiffFileSegments(a, b, func(op ethdb.FileSegmentDiffOp, key, value []byte) error {
+		diffs = append(diffs, fmt.Sprintf("%d:%s=%s", op, key, value))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{
+		fmt.Sprintf("%d:d=4", ethdb.FileSegmentDiffAdded),
+		fmt.Sprintf("%d:a=x", ethdb.FileSegmentDiffChanged),
+		fmt.Sprintf("%d:b=2", ethdb.FileSegmentDiffRemoved),
+	}
+	if !reflect.DeepEqual(diffs, exp) {
+		t.Fatalf("unexpected diffs: %v", diffs)
+	}
+
+	b.Close()
+	if err := ethdb.DiffFileSegments(a, b, func(op ethdb.FileSegmentDiffOp, key, value []byte) error { return nil }); err != ethdb.ErrFileSegmentClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestOpenAndVerify(t *testing.T) {
+	src := MustOpenFileSegment([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+	defer src.Close()
+
+	// Copy segment & verify against the source checksum.
+	var buf bytes.Buffer
+	if _, err := src.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := MustTempFile()
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ethdb.OpenAndVerify(path, src.Checksum())
+	if err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure a corrupted copy is rejected.
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xFF
+	if err := ioutil.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	} else if _, err := ethdb.OpenAndVerify(path, src.Checksum()); err != ethdb.ErrFileSegmentChecksumMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ensure a mismatched expected checksum is rejected.
+	b[len(b)-1] ^= 0xFF
+	if err := ioutil.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	} else if _, err := ethdb.OpenAndVerify(path, make([]byte, 8)); err != ethdb.ErrFileSegmentChecksumMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReindexFileSegment(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if err := EncodeToFileSegment(path, keys, keys); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clear the index, count & checksum but leave the index offset intact.
+	buf := append([]byte{}, exp...)
+	indexOffset := binary.BigEndian.Uint64(buf[12:20])
+	copy(buf[4:12], make([]byte, 8))
+	copy(buf[20:], make([]byte, 16))
+	copy(buf[indexOffset:], make([]byte, uint64(len(buf))-indexOffset))
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	} else if err := ethdb.VerifyFileSegment(path); err == nil {
+		t.Fatal("expected corrupt segment")
+	}
+
+	if err := ethdb.ReindexFileSegment(path); err != nil {
+		t.Fatal(err)
+	} else if err := ethdb.VerifyFileSegment(path); err != nil {
+		t.Fatal(err)
+	} else if buf, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, exp) {
+		t.Fatal("unexpected reindexed segment")
+	}
+}
+
+func TestFileSegment_GetEntry(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("bb")}, [][]byte{[]byte("1"), []byte("22")})
+	defer s.Close()
+
+	var e ethdb.KeyValue
+	if err := s.GetEntry([]byte("bb"), &e); err != nil {
+		t.Fatal(err)
+	} else if string(e.Key) != "bb" || string(e.Value) != "22" {
+		t.Fatalf("unexpected entry: %q=%q", e.Key, e.Value)
+	}
+
+	// Ensure missing keys leave the entry untouched.
+	if err := s.GetEntry([]byte("c"), &e); err != common.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if string(e.Key) != "bb" || string(e.Value) != "22" {
+		t.Fatalf("unexpected entry: %q=%q", e.Key, e.Value)
+	}
+
+	// Ensure repeated lookups reuse the entry's buffers.
+	key := []byte("a")
+	if n := testing.AllocsPerRun(100, func() { s.GetEntry(key, &e) }); n != 0 {
+		t.Fatalf("unexpected allocs: %v", n)
+	} else if string(e.Key) != "a" || string(e.Value) != "1" {
+		t.Fatalf("unexpected entry: %q=%q", e.Key, e.Value)
+	}
+}
+
+func TestNewFileSegmentFromFile(t *testing.T) {
+	path := MustTempFile()
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove path to ensure the segment does not reopen it.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ethdb.NewFileSegmentFromFile("test", f)
+	if err != nil {
+		t.Fatal(err)
+	} else if v, err := s.Get([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "bar" {
+		t.Fatalf("unexpected value: %q", v)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := s.Open(); err != ethdb.ErrFileSegmentNotReopenable {
+		t.Fatalf("unexpected reopen error: %v", err)
+	}
+
+	// Ensure the file was closed by the segment.
+	if err := f.Close(); err == nil {
+		t.Fatal("expected file to already be closed")
+	}
+}
+
+func TestFileSegment_AccessTime(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+	defer s.Close()
+
+	if !s.AccessTime().IsZero() {
+		t.Fatal("expected zero access time before first read")
+	}
+
+	before := time.Now()
+	if _, err := s.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if atime := s.AccessTime(); atime.Before(before) {
+		t.Fatalf("access time not updated by Get: %v", atime)
+	}
+
+	// Reads within the resolution do not update the access time.
+	before = s.AccessTime()
+	s.Iterator().Close()
+	if atime := s.AccessTime(); !atime.Equal(before) {
+		t.Fatalf("access time updated within resolution: %v", atime)
+	}
+
+	if testing.Short() {
+		t.Skip("skipping update after resolution in short mode")
+	}
+	time.Sleep(ethdb.FileSegmentAccessTimeResolution)
+	s.Iterator().Close()
+	if atime := s.AccessTime(); !atime.After(before) {
+		t.Fatalf("access time not updated by Iterator: %v", atime)
+	}
+}
+
+func TestFileSegment_GetOrDefault(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+	defer s.Close()
+
+	if v := s.GetOrDefault([]byte("a"), []byte("x")); string(v) != "1" {
+		t.Fatalf("unexpected value: %q", v)
+	} else if v := s.GetOrDefault([]byte("b"), []byte("x")); string(v) != "x" {
+		t.Fatalf("unexpected default: %q", v)
+	}
+	if v, err := s.TryGetOrDefault([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	} else if v != nil {
+		t.Fatalf("unexpected default: %q", v)
+	}
+}
+
+func TestFileSegment_SliceIterator(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	s := MustOpenFileSegment(keys, keys)
+	defer s.Close()
+
+	for _, tt := range []struct {
+		start, limit int
+		keys         []string
+	}{
+		{0, 2, []string{"a", "b"}},
+		{1, 2, []string{"b", "c"}},
+		{2, 10, []string{"c", "d"}},
+		{4, 1, nil},
+		{10, 1, nil},
+		{0, 0, nil},
+	} {
+		itr := s.SliceIterator(tt.start, tt.limit)
+		var a []string
+		for itr.Next() {
+			a = append(a, string(itr.Key()))
+		}
+		if err := itr.Close(); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(a, tt.keys) {
+			t.Fatalf("SliceIterator(%d, %d)=%v, expected %v", tt.start, tt.limit, a, tt.keys)
+		}
+	}
+}
+
+func TestFileSegment_TailIterator(t *testing.T) {
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%03d", i))
+	}
+	s := MustOpenFileSegment(keys, keys)
+	defer s.Close()
+
+	for _, tt := range []struct {
+		n    int
+		keys []string
+	}{
+		{3, []string{"097", "098", "099"}},
+		{1, []string{"099"}},
+		{0, nil},
+		{-1, nil},
+	} {
+		itr := s.TailIterator(tt.n)
+		var a []string
+		for itr.Next() {
+			a = append(a, string(itr.Key()))
+		}
+		if err := itr.Close(); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(a, tt.keys) {
+			t.Fatalf("TailIterator(%d)=%v, expected %v", tt.n, a, tt.keys)
+		}
+	}
+
+	// Ensure n is clamped to the length of the segment.
+	itr := s.TailIterator(1000)
+	var n int
+	for ; itr.Next(); n++ {
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatal(err)
+	} else if n != len(keys) {
+		t.Fatalf("unexpected count: %d", n)
+	}
+}
+
+func TestFileSegment_EntriesAt(t *testing.T) {
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%03d", i))
+	}
+	s := MustOpenFileSegment(keys, keys)
+	defer s.Close()
+
+	a, err := s.EntriesAt([]int{42, 7, 99, 7, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range a {
+		if !bytes.Equal(e.Key, e.Value) {
+			t.Fatalf("value mismatch: %q=%q", e.Key, e.Value)
+		}
+		got = append(got, string(e.Key))
+	}
+	if exp := []string{"042", "007", "099", "007", "000"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("EntriesAt()=%v, expected %v", got, exp)
+	}
+
+	if _, err := s.EntriesAt([]int{1, 100}); err == nil || !strings.Contains(err.Error(), "100") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFileSegment_Prewarm(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%04d", i))
+	}
+	if err := EncodeToFileSegment(path, keys, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Prewarm([][]byte{[]byte("0000"), []byte("0999"), []byte("no such key")}); err != nil {
+		t.Fatal(err)
+	} else if v, err := s.Get([]byte("0999")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "0999" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+func TestFileSegment_ErrClosed(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get([]byte("foo")); err != ethdb.ErrFileSegmentClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := s.Has([]byte("foo")); err != ethdb.ErrFileSegmentClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	itr := s.Iterator()
+	if itr.Next() {
+		t.Fatal("unexpected entry")
+	} else if err := itr.Close(); err != ethdb.ErrFileSegmentClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Reopening clears the closed state.
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "bar" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+func TestFileSegment_PrefetchWindow(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%04d", i))
+	}
+	if err := EncodeToFileSegment(path, keys, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	s.PrefetchWindow = 1024
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	itr := s.Iterator()
+	var i int
+	for ; itr.Next(); i++ {
+		if !bytes.Equal(itr.Key(), keys[i]) {
+			t.Fatalf("unexpected key %d: %q", i, itr.Key())
+		}
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatal(err)
+	} else if i != len(keys) {
+		t.Fatalf("unexpected count: %d", i)
+	}
+}
+
+func TestFileSegment_NoIndex(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	enc := ethdb.NewFileSegmentEncoder(path)
+	enc.NoIndex = true
+	if err := enc.Open(); err != nil {
+		t.Fatal(err)
+	} else if err := enc.EncodeKeyValue([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	} else if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Indexed() {
+		t.Fatal("expected no index")
+	} else if s.Len() != 1 {
+		t.Fatalf("unexpected len: %d", s.Len())
+	} else if len(s.Index()) != 0 {
+		t.Fatalf("unexpected index size: %d", len(s.Index()))
+	}
+
+	// Random access is not supported.
+	if _, err := s.Get([]byte("foo")); err != ethdb.ErrFileSegmentNoIndex {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := s.Has([]byte("foo")); err != ethdb.ErrFileSegmentNoIndex {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Iteration still works.
+	itr := s.Iterator()
+	defer itr.Close()
+	if !itr.Next() {
+		t.Fatal("expected entry")
+	} else if string(itr.Key()) != "foo" || string(itr.Value()) != "bar" {
+		t.Fatalf("unexpected entry: %q=%q", itr.Key(), itr.Value())
+	} else if itr.Next() {
+		t.Fatal("unexpected entry")
+	}
+}
+
+func TestFileSegment_Open(t *testing.T) {
+	t.Run("ErrIndexOutOfBounds", func(t *testing.T) {
+		path := MustTempFile()
+		defer os.Remove(path)
+
+		if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Overwrite index offset with a position past the end of the file.
+		if f, err := os.OpenFile(path, os.O_RDWR, 0666); err != nil {
+			t.Fatal(err)
+		} else if _, err := f.WriteAt([]byte{0xFF, 0, 0, 0, 0, 0, 0, 0}, 12); err != nil {
+			t.Fatal(err)
+		} else if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); !errors.Is(err, ethdb.ErrFileSegmentCorrupt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrTruncated", func(t *testing.T) {
+		path := MustTempFile()
+		defer os.Remove(path)
+
+		if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Truncate into the index, then into the header.
+		for _, size := range []int64{int64(ethdb.FileSegmentHeaderSize) + 16, 10} {
+			if err := os.Truncate(path, size); err != nil {
+				t.Fatal(err)
+			}
+			s := ethdb.NewFileSegment("test", path)
+			if err := s.Open(); !errors.Is(err, ethdb.ErrFileSegmentTruncated) {
+				t.Fatalf("unexpected error at size %d: %v", size, err)
+			}
+		}
+	})
+}
+
+func TestFileSegmentEncoder_ErrDuplicateKey(t *testing.T) {
+	var buf SeekableBuffer
+	enc := ethdb.NewFileSegmentEncoderTo(&buf)
+	if err := enc.Open(); err != nil {
+		t.Fatal(err)
+	} else if err := enc.EncodeKeyValue([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	} else if err := enc.EncodeKeyValue([]byte("foo"), []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Flush(); !errors.Is(err, ethdb.ErrFileSegmentDuplicateKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFileSegment_Open_ErrBadMagic(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := ioutil.WriteFile(path, append([]byte("XXXX"), make([]byte, ethdb.FileSegmentHeaderSize)...), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); !errors.Is(err, ethdb.ErrFileSegmentBadMagic) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !strings.Contains(err.Error(), `"XXXX"`) {
+		t.Fatalf("expected magic in error: %v", err)
+	}
+}
+
+// Ensure a malformed segment with duplicate keys returns the first key in probe order.
+func TestFileSegment_Get_DuplicateKey(t *testing.T) {
+	home := int(xxhash.Sum64([]byte("foo")) & 1)
+
+	for _, tt := range []struct {
+		name  string
+		slots [2]int // entry index stored in each index slot
+		value string
+	}{
+		{name: "FirstAtHome", slots: [2]int{0, 1}, value: "1"},
+		{name: "SecondAtHome", slots: [2]int{1, 0}, value: "2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := MustTempFile()
+			defer os.Remove(path)
+
+			// Hand-craft two entries with the same key followed by a 2-slot index.
+			entries := [][]byte{
+				append([]byte{3}, "foo\x011"...),
+				append([]byte{3}, "foo\x012"...),
+			}
+			offsets := []uint64{uint64(ethdb.FileSegmentHeaderSize), uint64(ethdb.FileSegmentHeaderSize + len(entries[0]))}
+			indexOffset := offsets[1] + uint64(len(entries[1]))
+
+			buf := make([]byte, ethdb.FileSegmentHeaderSize)
+			copy(buf, ethdb.FileSegmentMagic)
+			binary.BigEndian.PutUint64(buf[12:], indexOffset)
+			binary.BigEndian.PutUint64(buf[20:], 2)
+			binary.BigEndian.PutUint64(buf[28:], 2)
+			buf = append(buf, entries[0]...)
+			buf = append(buf, entries[1]...)
+
+			index := make([]byte, 16)
+			binary.BigEndian.PutUint64(index[home*8:], offsets[tt.slots[0]])
+			binary.BigEndian.PutUint64(index[(home^1)*8:], offsets[tt.slots[1]])
+			buf = append(buf, index...)
+
+			if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			s := ethdb.NewFileSegment("test", path)
+			if err := s.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if v, err := s.Get([]byte("foo")); err != nil {
+				t.Fatal(err)
+			} else if string(v) != tt.value {
+				t.Fatalf("unexpected value: %q", v)
+			}
+		})
+	}
+}
+
+// Ensure ethdb.FileSegment can fetch keys using randomized test data.
+func TestFileSegment_Quick(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short")
+	}
+
+	const maxCount = 10000
+	const maxKeyLen = 2000
+	const maxValueLen = 10000
+
+	quick.Check(func(keys, values [][]byte) bool {
+		path := MustTempFile()
+		defer os.Remove(path)
+
+		// Write data to file.
+		if err := EncodeToFileSegment(path, keys, values); err != nil {
+			t.Fatal(err)
+		}
+
+		// Open as file.
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// Verify all key/value pairs exist.
+		for i := range keys {
+			if v, err := s.Get(keys[i]); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(values[i], v) {
+				t.Fatalf("value mismatch: (key=%q) expected %q, got %q", keys[i], values[i], v)
+			}
+		}
+
+		// Verify we can iterate them in order.
+		itr, i := s.Iterator(), 0
+		for ; itr.Next(); i++ {
+			if !bytes.Equal(itr.Key(), keys[i]) {
+				t.Fatalf("iterator key mismatch:\nexpected %x\ngot %x", keys[i], itr.Key())
+			} else if !bytes.Equal(itr.Value(), values[i]) {
+				t.Fatal("iterator value mismatch")
+			}
+		}
+		if i != len(keys) {
+			t.Fatal("short iterator")
+		}
+
+		return true
+	}, &quick.Config{
+		MaxCount: 10,
+		Values: func(args []reflect.Value, rand *rand.Rand) {
+			n := rand.Intn(maxCount-1) + 1
+			args[0] = reflect.ValueOf(generateKeys(n, 1, maxKeyLen-1, rand))
+			args[1] = reflect.ValueOf(generateValues(n, 0, maxValueLen, rand))
+		},
+	})
+}
+
+func TestFileSegmentIterator_Entry(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+	defer s.Close()
+
+	itr := s.Iterator().(*ethdb.FileSegmentIterator)
+	defer itr.Close()
+
+	var a []ethdb.KeyValue
+	for itr.Next() {
+		a = append(a, itr.Entry())
+	}
+	if !reflect.DeepEqual(a, []ethdb.KeyValue{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+	}) {
+		t.Fatalf("unexpected entries: %q", a)
+	}
+}
+
+func TestFileSegment_OffsetIterator(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("bb")}, [][]byte{[]byte("1"), []byte("22")})
+	defer s.Close()
+
+	itr := s.OffsetIterator()
+	defer itr.Close()
+
+	var a [][2]int64
+	for itr.Next() {
+		a = append(a, [2]int64{itr.Offset(), int64(itr.Length())})
+	}
+	hdr := int64(ethdb.FileSegmentHeaderSize)
+	if exp := [][2]int64{{hdr, 4}, {hdr + 4, 6}}; !reflect.DeepEqual(a, exp) {
+		t.Fatalf("unexpected offsets: %v, expected %v", a, exp)
+	}
+}
+
+func TestFileSegment_GetAtOffset(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("bb")}, [][]byte{[]byte("1"), []byte("22")})
+	defer s.Close()
+
+	itr := s.OffsetIterator()
+	defer itr.Close()
+	for itr.Next() {
+		if key, value, err := s.GetAtOffset(itr.Offset()); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(key, itr.Key()) || !bytes.Equal(value, itr.Value()) {
+			t.Fatalf("unexpected entry: %q=%q", key, value)
+		}
+	}
+
+	for _, offset := range []int64{-1, 0, int64(ethdb.FileSegmentHeaderSize) + 1, s.IndexOffset()} {
+		if _, _, err := s.GetAtOffset(offset); !errors.Is(err, ethdb.ErrFileSegmentBadOffset) {
+			t.Fatalf("unexpected error at offset %d: %v", offset, err)
+		}
+	}
+}
+
+func TestFileSegment_AggregateRange(t *testing.T) {
+	keys, values := make([][]byte, 100), make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%03d", i))
+		values[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(values[i], uint64(i))
+	}
+	s := MustOpenFileSegment(keys, values)
+	defer s.Close()
+
+	sum := func(acc, value []byte) []byte {
+		binary.BigEndian.PutUint64(acc, binary.BigEndian.Uint64(acc)+binary.BigEndian.Uint64(value))
+		return acc
+	}
+
+	for _, tt := range []struct {
+		start, end []byte
+		sum        uint64
+	}{
+		{[]byte("010"), []byte("015"), 10 + 11 + 12 + 13 + 14},
+		{nil, []byte("003"), 0 + 1 + 2},
+		{[]byte("098"), nil, 98 + 99},
+		{nil, nil, 4950},
+		{[]byte("200"), nil, 0},
+	} {
+		if acc, err := s.AggregateRange(tt.start, tt.end, sum, make([]byte, 8)); err != nil {
+			t.Fatal(err)
+		} else if v := binary.BigEndian.Uint64(acc); v != tt.sum {
+			t.Fatalf("AggregateRange(%q, %q)=%d, expected %d", tt.start, tt.end, v, tt.sum)
+		}
+	}
+}
+
+func TestFileSegment_SelfCheck(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+		defer s.Close()
+		if err := s.SelfCheck(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ErrClosed", func(t *testing.T) {
+		s := MustOpenFileSegment([][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+		s.Close()
+		if err := s.SelfCheck(); err != ethdb.ErrFileSegmentClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrCorrupt", func(t *testing.T) {
+		s := MustOpenCorruptFileSegment()
+		defer s.Close()
+		if err := s.SelfCheck(); !errors.Is(err, ethdb.ErrFileSegmentCorrupt) || !strings.Contains(err.Error(), "invalid entry") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrIndexDesync", func(t *testing.T) {
+		path := MustTempFile()
+		defer os.Remove(path)
+
+		if err := EncodeToFileSegment(path, [][]byte{[]byte("a")}, [][]byte{[]byte("1")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Clear out the index so no keys can be found.
+		s := ethdb.NewFileSegment("test", path)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		indexOffset, indexSize := s.IndexOffset(), len(s.Index())
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if f, err := os.OpenFile(path, os.O_RDWR, 0666); err != nil {
+			t.Fatal(err)
+		} else if _, err := f.WriteAt(make([]byte, indexSize), indexOffset); err != nil {
+			t.Fatal(err)
+		} else if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err, ok := s.SelfCheck().(*ethdb.FileSegmentMismatchError); !ok {
+			t.Fatalf("unexpected error: %#v", err)
+		} else if string(err.Key) != "a" || string(err.IteratorValue) != "1" || err.GetValue != nil {
+			t.Fatalf("unexpected mismatch: %s", err)
+		}
+	})
+}
+
+func TestFileSegment_BestEffortIterator(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := EncodeToFileSegment(path,
+		[][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		[][]byte{[]byte("1"), []byte("2"), []byte("3")},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the key length of the second entry.
+	const offset = int64(ethdb.FileSegmentHeaderSize + 4)
+	if f, err := os.OpenFile(path, os.O_RDWR, 0666); err != nil {
+		t.Fatal(err)
+	} else if _, err := f.WriteAt([]byte{0xFF}, offset); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	itr := s.BestEffortIterator()
+	defer itr.Close()
+
+	var keys []string
+	for itr.Next() {
+		keys = append(keys, string(itr.Key())+"="+string(itr.Value()))
+	}
+	if !reflect.DeepEqual(keys, []string{"a=1", "c=3"}) {
+		t.Fatalf("unexpected entries: %v", keys)
+	} else if skipped := itr.Skipped(); !reflect.DeepEqual(skipped, []ethdb.FileSegmentRegion{{Offset: offset, Size: 4}}) {
+		t.Fatalf("unexpected skipped regions: %v", skipped)
+	}
+}
+
+func TestFileSegmentEncoder_Abort(t *testing.T) {
+	t.Run("RemovesFile", func(t *testing.T) {
+		path := MustTempFile()
+		defer os.Remove(path)
+
+		enc := ethdb.NewFileSegmentEncoder(path)
+		if err := enc.Open(); err != nil {
+			t.Fatal(err)
+		} else if err := enc.EncodeKeyValue([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if err := enc.Abort(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected file to be removed: %v", err)
+		}
+	})
+
+	t.Run("NoopAfterClose", func(t *testing.T) {
+		path := MustTempFile()
+		defer os.Remove(path)
+
 		enc := ethdb.NewFileSegmentEncoder(path)
 		if err := enc.Open(); err != nil {
 			t.Fatal(err)
@@ -30,92 +1284,302 @@ func TestFileSegment_Get(t *testing.T) {
 			t.Fatal(err)
 		} else if err := enc.Close(); err != nil {
 			t.Fatal(err)
+		} else if err := enc.Abort(); err != nil {
+			t.Fatal(err)
 		}
 
-		// Open as file segment.
-		s := ethdb.NewFileSegment("test", path)
-		if err := s.Open(); err != nil {
+		if err := ethdb.VerifyFileSegment(path); err != nil {
 			t.Fatal(err)
 		}
-		defer s.Close()
+	})
+}
 
-		// Fetch existing keys.
-		if v, err := s.Get([]byte("foo")); err != nil {
+func TestFileSegmentEncoder_OnProgress(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	enc := ethdb.NewFileSegmentEncoder(path)
+	enc.ProgressInterval = 2
+
+	var calls [][2]int64
+	enc.OnProgress = func(done, total int64) { calls = append(calls, [2]int64{done, total}) }
+
+	if err := enc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := enc.EncodeKeyValue([]byte(key), []byte("v")); err != nil {
 			t.Fatal(err)
-		} else if string(v) != "bar" {
-			t.Fatalf("unexpected value: %q", v)
 		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
 
-		// Fetch unknown key.
-		if v, err := s.Get([]byte("no_such_key")); err != common.ErrNotFound {
-			t.Fatalf("unexpected error: %s", err)
-		} else if v != nil {
-			t.Fatalf("expected nil value, got %q", v)
+	if !reflect.DeepEqual(calls, [][2]int64{{2, -1}, {4, -1}, {2, 5}, {4, 5}, {5, 5}}) {
+		t.Fatalf("unexpected progress: %v", calls)
+	}
+}
+
+func TestFileSegmentEncoder_Paranoid(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		var buf SeekableBuffer
+		enc := ethdb.NewFileSegmentEncoderTo(&buf)
+		enc.Paranoid = true
+		if err := enc.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := enc.EncodeKeyValue([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatal(err)
+			}
 		}
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	})
 
-		// Close file segment.
-		if err := s.Close(); err != nil {
+	// Ensure an entry that differs from what the caller passed in is caught,
+	// even though the segment's own checksum & index are consistent with it.
+	t.Run("ErrCorrupt", func(t *testing.T) {
+		buf := &CorruptingSeekableBuffer{Match: []byte("value500")}
+		enc := ethdb.NewFileSegmentEncoderTo(buf)
+		enc.Paranoid = true
+		if err := enc.Open(); err != nil {
 			t.Fatal(err)
 		}
+		for i := 0; i < 1000; i++ {
+			if err := enc.EncodeKeyValue([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Flush(); err == nil || !strings.Contains(err.Error(), "paranoid check failed") {
+			t.Fatalf("unexpected error: %v", err)
+		}
 	})
 }
 
-// Ensure ethdb.FileSegment can fetch keys using randomized test data.
-func TestFileSegment_Quick(t *testing.T) {
-	if testing.Short() {
-		t.Skip("short")
+// CorruptingSeekableBuffer is a SeekableBuffer that flips the last byte of
+// any write equal to Match before storing it.
+type CorruptingSeekableBuffer struct {
+	SeekableBuffer
+	Match []byte
+}
+
+func (b *CorruptingSeekableBuffer) Write(p []byte) (int, error) {
+	if bytes.Equal(p, b.Match) {
+		p = append([]byte{}, p...)
+		p[len(p)-1] ^= 0xFF
 	}
+	return b.SeekableBuffer.Write(p)
+}
 
-	const maxCount = 10000
-	const maxKeyLen = 2000
-	const maxValueLen = 10000
+func TestFileSegment_WriteTo(t *testing.T) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := EncodeToFileSegment(path, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var buf bytes.Buffer
+	if n, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	} else if n != int64(s.Size()) {
+		t.Fatalf("unexpected byte count: %d", n)
+	}
+
+	if exp, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), exp) {
+		t.Fatal("data mismatch")
+	}
+
+	// Ensure a closed segment is not written as an empty file.
+	s.Close()
+	if n, err := s.WriteTo(&buf); err != ethdb.ErrFileSegmentClosed {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+}
+
+func TestConcatFileSegments(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("c"), []byte("d")}, [][]byte{[]byte("3"), []byte("4")})
+		defer b.Close()
 
-	quick.Check(func(keys, values [][]byte) bool {
 		path := MustTempFile()
 		defer os.Remove(path)
-
-		// Write data to file.
-		if err := EncodeToFileSegment(path, keys, values); err != nil {
+		if err := ethdb.ConcatFileSegments(path, []*ethdb.FileSegment{a, b}); err != nil {
 			t.Fatal(err)
 		}
 
-		// Open as file.
 		s := ethdb.NewFileSegment("test", path)
 		if err := s.Open(); err != nil {
 			t.Fatal(err)
 		}
 		defer s.Close()
 
-		// Verify all key/value pairs exist.
-		for i := range keys {
-			if v, err := s.Get(keys[i]); err != nil {
-				t.Fatal(err)
-			} else if !bytes.Equal(values[i], v) {
-				t.Fatalf("value mismatch: (key=%q) expected %q, got %q", keys[i], values[i], v)
-			}
+		exp := MustOpenFileSegment(
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")},
+			[][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")},
+		)
+		defer exp.Close()
+
+		if ok, err := ethdb.EqualFileSegments(s, exp); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected equal segments")
+		} else if err := s.SelfCheck(); err != nil {
+			t.Fatal(err)
 		}
+	})
 
-		// Verify we can iterate them in order.
-		itr, i := s.Iterator(), 0
-		for ; itr.Next(); i++ {
-			if !bytes.Equal(itr.Key(), keys[i]) {
-				t.Fatalf("iterator key mismatch:\nexpected %x\ngot %x", keys[i], itr.Key())
-			} else if !bytes.Equal(itr.Value(), values[i]) {
-				t.Fatal("iterator value mismatch")
-			}
+	t.Run("ErrFileSegmentRangeOverlap", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("a"), []byte("c")}, [][]byte{[]byte("1"), []byte("3")})
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("b")}, [][]byte{[]byte("2")})
+		defer b.Close()
+
+		path := MustTempFile()
+		defer os.Remove(path)
+		if err := ethdb.ConcatFileSegments(path, []*ethdb.FileSegment{a, b}); err != ethdb.ErrFileSegmentRangeOverlap {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected output to be removed: %v", err)
 		}
-		if i != len(keys) {
-			t.Fatal("short iterator")
+	})
+
+	// Ensure overlap is detected using each segment's full key range, not the
+	// order its entries were inserted in.
+	t.Run("ErrFileSegmentRangeOverlap/Unsorted", func(t *testing.T) {
+		for _, tt := range []struct {
+			name string
+			a, b [][]byte
+		}{
+			{"First", [][]byte{[]byte("z"), []byte("a")}, [][]byte{[]byte("b")}},
+			{"Second", [][]byte{[]byte("a"), []byte("c")}, [][]byte{[]byte("d"), []byte("b")}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				a := MustOpenFileSegment(tt.a, make([][]byte, len(tt.a)))
+				defer a.Close()
+				b := MustOpenFileSegment(tt.b, make([][]byte, len(tt.b)))
+				defer b.Close()
+
+				path := MustTempFile()
+				defer os.Remove(path)
+				if err := ethdb.ConcatFileSegments(path, []*ethdb.FileSegment{a, b}); err != ethdb.ErrFileSegmentRangeOverlap {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
 		}
+	})
 
-		return true
-	}, &quick.Config{
-		MaxCount: 10,
-		Values: func(args []reflect.Value, rand *rand.Rand) {
-			n := rand.Intn(maxCount-1) + 1
-			args[0] = reflect.ValueOf(generateKeys(n, 1, maxKeyLen-1, rand))
-			args[1] = reflect.ValueOf(generateValues(n, 0, maxValueLen, rand))
-		},
+	t.Run("ErrFileSegmentClosed", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+		a.Close()
+
+		path := MustTempFile()
+		defer os.Remove(path)
+		if err := ethdb.ConcatFileSegments(path, []*ethdb.FileSegment{a}); err != ethdb.ErrFileSegmentClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestCompareFileSegments(t *testing.T) {
+	t.Run("Equal", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("foo")}, [][]byte{[]byte("0"), []byte("1")})
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("foo")}, [][]byte{[]byte("0"), []byte("1")})
+		defer b.Close()
+
+		if key, err := ethdb.CompareFileSegments(a, b); err != nil {
+			t.Fatal(err)
+		} else if key != nil {
+			t.Fatalf("unexpected key: %q", key)
+		}
+		if ok, err := ethdb.EqualFileSegments(a, b); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected equal")
+		}
+	})
+
+	t.Run("ValueMismatch", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("foo")}, [][]byte{[]byte("0"), []byte("1")})
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("foo")}, [][]byte{[]byte("0"), []byte("X")})
+		defer b.Close()
+
+		if key, err := ethdb.CompareFileSegments(a, b); err != nil {
+			t.Fatal(err)
+		} else if string(key) != "foo" {
+			t.Fatalf("unexpected key: %q", key)
+		}
+		if ok, err := ethdb.EqualFileSegments(a, b); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatal("expected not equal")
+		}
+	})
+
+	t.Run("KeyMismatch", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("foo")}, [][]byte{[]byte("0"), []byte("1")})
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("baz")}, [][]byte{[]byte("0"), []byte("1")})
+		defer b.Close()
+
+		if key, err := ethdb.CompareFileSegments(a, b); err != nil {
+			t.Fatal(err)
+		} else if string(key) != "baz" {
+			t.Fatalf("unexpected key: %q", key)
+		}
+	})
+
+	t.Run("Short", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("bar"), []byte("foo")}, [][]byte{[]byte("0"), []byte("1")})
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("bar")}, [][]byte{[]byte("0")})
+		defer b.Close()
+
+		if key, err := ethdb.CompareFileSegments(a, b); err != nil {
+			t.Fatal(err)
+		} else if string(key) != "foo" {
+			t.Fatalf("unexpected key: %q", key)
+		}
+	})
+
+	t.Run("ErrClosed", func(t *testing.T) {
+		a := MustOpenFileSegment([][]byte{[]byte("bar")}, [][]byte{[]byte("0")})
+		b := MustOpenFileSegment([][]byte{[]byte("foo")}, [][]byte{[]byte("1")})
+		a.Close()
+		b.Close()
+
+		if ok, err := ethdb.EqualFileSegments(a, b); err != ethdb.ErrFileSegmentClosed {
+			t.Fatalf("unexpected result: %v, %v", ok, err)
+		}
+	})
+
+	t.Run("ErrCorrupt", func(t *testing.T) {
+		a := MustOpenCorruptFileSegment()
+		defer a.Close()
+		b := MustOpenFileSegment([][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+		defer b.Close()
+
+		if key, err := ethdb.CompareFileSegments(a, b); !errors.Is(err, ethdb.ErrFileSegmentCorrupt) {
+			t.Fatalf("unexpected result: %q, %v", key, err)
+		} else if key, err := ethdb.CompareFileSegments(b, a); !errors.Is(err, ethdb.ErrFileSegmentCorrupt) {
+			t.Fatalf("unexpected result: %q, %v", key, err)
+		}
 	})
 }
 
@@ -157,10 +1621,163 @@ func BenchmarkFileSegment_Get(b *testing.B) {
 	}
 }
 
+// Measures Get from concurrent readers, which share the access time word.
+func BenchmarkFileSegment_Get_Parallel(b *testing.B) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	const n = 100000
+	keys, values := make([][]byte, n), make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = make([]byte, 32)
+		binary.BigEndian.PutUint64(keys[i], uint64(i))
+		values[i] = make([]byte, 32)
+	}
+	EncodeToFileSegment(path, keys, values)
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		perm := rand.Perm(n)
+		for i := 0; pb.Next(); i++ {
+			if _, err := s.Get(keys[perm[i%len(perm)]]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFileSegmentIterator(b *testing.B) {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	const n = 10000
+	keys, values := make([][]byte, n), make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, 32)
+		binary.BigEndian.PutUint64(keys[i], uint64(i))
+		values[i] = make([]byte, 1024)
+	}
+	if err := EncodeToFileSegment(path, keys, values); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, window := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("prefetch=%d", window), func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Reopen with a cold page cache on every pass so the
+				// prefetch window is measured against disk reads.
+				b.StopTimer()
+				if err := DropPageCache(path); err != nil {
+					b.Fatal(err)
+				}
+				s := ethdb.NewFileSegment("test", path)
+				s.PrefetchWindow = window
+				if err := s.Open(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				var sum int
+				itr := s.Iterator()
+				for itr.Next() {
+					sum += int(itr.Value()[0])
+				}
+				itr.Close()
+
+				b.StopTimer()
+				if err := s.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkFileSegment_Open(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			path := MustTempFile()
+			defer os.Remove(path)
+
+			keys := make([][]byte, n)
+			for i := range keys {
+				keys[i] = make([]byte, 32)
+				binary.BigEndian.PutUint64(keys[i], uint64(i))
+			}
+			if err := EncodeToFileSegment(path, keys, keys); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				s := ethdb.NewFileSegment("test", path)
+				if err := s.Open(); err != nil {
+					b.Fatal(err)
+				} else if err := s.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// SeekableBuffer is an in-memory io.ReadWriteSeeker.
+type SeekableBuffer struct {
+	buf []byte
+	pos int64
+}
+
+// Bytes returns the contents of the buffer.
+func (b *SeekableBuffer) Bytes() []byte { return b.buf }
+
+func (b *SeekableBuffer) Read(p []byte) (int, error) {
+	if b.pos >= int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[b.pos:])
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *SeekableBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + int64(len(p)); end > int64(len(b.buf)) {
+		b.buf = append(b.buf, make([]byte, end-int64(len(b.buf)))...)
+	}
+	n := copy(b.buf[b.pos:], p)
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *SeekableBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += int64(len(b.buf))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
 // EncodeToFileSegment encodes a set of key/value pairs to an ethdb.FileSegment at path.
 func EncodeToFileSegment(path string, keys, values [][]byte) error {
 	// Build file segment.
 	enc := ethdb.NewFileSegmentEncoder(path)
+	enc.Paranoid = *paranoid
 	if err := enc.Open(); err != nil {
 		return err
 	}
@@ -182,6 +1799,49 @@ func EncodeToFileSegment(path string, keys, values [][]byte) error {
 	return nil
 }
 
+// MustOpenFileSegment encodes key/value pairs to a temporary file segment and opens it.
+// The underlying file is removed once mapped so callers only need to close the segment.
+func MustOpenFileSegment(keys, values [][]byte) *ethdb.FileSegment {
+	path := MustTempFile()
+	defer os.Remove(path)
+
+	if err := EncodeToFileSegment(path, keys, values); err != nil {
+		panic(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// MustOpenCorruptFileSegment opens a segment of "a=1", "b=2" & "c=3" whose
+// second entry has a corrupt key length so iteration fails after "a".
+func MustOpenCorruptFileSegment() *ethdb.FileSegment {
+	var buf SeekableBuffer
+	enc := ethdb.NewFileSegmentEncoderTo(&buf)
+	if err := enc.Open(); err != nil {
+		panic(err)
+	}
+	for _, kv := range []string{"a1", "b2", "c3"} {
+		if err := enc.EncodeKeyValue([]byte(kv[:1]), []byte(kv[1:])); err != nil {
+			panic(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		panic(err)
+	}
+
+	data := buf.Bytes()
+	data[ethdb.FileSegmentHeaderSize+4] = 0xFF
+	s, err := ethdb.NewFileSegmentFromBytes("test", data)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
 // generateKeys returns a set of n unique, randomly generated keys.
 func generateKeys(n, min, max int, rand *rand.Rand) [][]byte {
 	a := make([][]byte, n)
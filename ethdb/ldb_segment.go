@@ -1,15 +1,19 @@
 package ethdb
 
 import (
+	"bytes"
+
 	"github.com/bcskill/bcschain/v3/common"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // Ensure implementation implements interface.
 var _ MutableSegment = (*LDBSegment)(nil)
+var _ Iteratee = (*LDBSegment)(nil)
 
 // LDBSegement represents a mutable segment in a Table.
 // These segments can eventually be rebuilt into immutable FileSegments.
@@ -88,16 +92,36 @@ func (s *LDBSegment) Iterator() SegmentIterator {
 
 // CompactTo writes the segment to disk as a file segment.
 func (s *LDBSegment) CompactTo(path string) error {
+	return ExportSegment(path, s, nil, nil)
+}
+
+// NewIterator returns an iterator over keys beginning with prefix that are
+// greater than or equal to prefix+start, in sorted order.
+func (s *LDBSegment) NewIterator(prefix, start []byte) SegmentIterator {
+	rng := util.BytesPrefix(prefix)
+	rng.Start = append(append([]byte{}, prefix...), start...)
+	return &ldbSegmentIterator{s.db.NewIterator(rng, nil)}
+}
+
+// ExportSegment writes all key/value pairs in db within the range [start, end)
+// to a file segment at path. A nil start or end leaves that side unbounded.
+// db must iterate in sorted order, as LevelDB does, so iteration stops at the
+// first key past end and the segment iterates in sorted order.
+func ExportSegment(path string, db Iteratee, start, end []byte) error {
 	enc := NewFileSegmentEncoder(path)
 	if err := enc.Open(); err != nil {
 		return err
 	}
+	defer enc.Abort()
 
-	itr := s.Iterator()
+	itr := db.NewIterator(nil, start)
 	defer itr.Close()
 
-	// Copy all LDB key/value pairs to the file segment.
+	// Copy all key/value pairs in range to the file segment.
 	for itr.Next() {
+		if end != nil && bytes.Compare(itr.Key(), end) >= 0 {
+			break
+		}
 		if err := enc.EncodeKeyValue(itr.Key(), itr.Value()); err != nil {
 			return err
 		}
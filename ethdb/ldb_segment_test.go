@@ -0,0 +1,48 @@
+package ethdb_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+func TestExportSegment(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	ldbSegment := ethdb.NewLDBSegment("test", filepath.Join(dir, "ldb"))
+	if err := ldbSegment.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ldbSegment.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := ldbSegment.Put([]byte(key), []byte(key+"v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Export only the [b, d) range.
+	path := filepath.Join(dir, "segment")
+	if err := ethdb.ExportSegment(path, ldbSegment, []byte("b"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ethdb.NewFileSegment("test", path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	exp := MustOpenFileSegment([][]byte{[]byte("b"), []byte("c")}, [][]byte{[]byte("bv"), []byte("cv")})
+	defer exp.Close()
+
+	if ok, err := ethdb.EqualFileSegments(s, exp); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("unexpected segment contents")
+	}
+}
+
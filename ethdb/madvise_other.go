@@ -0,0 +1,5 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package ethdb
+
+func madviseWillNeed(b []byte) error { return nil }
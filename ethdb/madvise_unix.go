@@ -0,0 +1,9 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ethdb
+
+import "golang.org/x/sys/unix"
+
+// madviseWillNeed hints to the kernel that b will be accessed soon so its
+// pages can be read ahead. b must start on a page boundary.
+func madviseWillNeed(b []byte) error { return unix.Madvise(b, unix.MADV_WILLNEED) }
@@ -0,0 +1,11 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package ethdb
+
+import "errors"
+
+var errMlockUnsupported = errors.New("ethdb: mlock not supported on this platform")
+
+func mlock(b []byte) error { return errMlockUnsupported }
+
+func munlock(b []byte) error { return errMlockUnsupported }
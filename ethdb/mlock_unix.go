@@ -0,0 +1,11 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ethdb
+
+import "golang.org/x/sys/unix"
+
+// mlock locks b into memory so it cannot be paged out.
+func mlock(b []byte) error { return unix.Mlock(b) }
+
+// munlock unlocks memory previously locked by mlock.
+func munlock(b []byte) error { return unix.Munlock(b) }
@@ -172,6 +172,9 @@ type Segment struct {
 	table   string // table name
 	name    string // segment name
 	path    string // local path
+
+	// Applied to the underlying file segment's MaxGetValueSize once fetched.
+	MaxGetValueSize int
 }
 
 // NewSegment returns a new instance of Segment.
@@ -243,6 +246,7 @@ func (s *Segment) ensureFileSegment(ctx context.Context) error {
 
 	// Open file segment on the local file.
 	s.segment = ethdb.NewFileSegment(s.name, s.path)
+	s.segment.MaxGetValueSize = s.MaxGetValueSize
 	if err := s.segment.Open(); err != nil {
 		return err
 	}
@@ -306,6 +310,10 @@ var _ ethdb.SegmentOpener = (*SegmentOpener)(nil)
 // SegmentOpener opens segments as a s3.Segments.
 type SegmentOpener struct {
 	Client *Client
+
+	// Applied to each opened segment's MaxGetValueSize. Zero, the default,
+	// disables the limit so existing tables with large values stay readable.
+	MaxGetValueSize int
 }
 
 // NewSegmentOpener returns a new instance of SegmentOpener.
@@ -351,7 +359,9 @@ func (o *SegmentOpener) ListSegmentNames(path, table string) ([]string, error) {
 
 // OpenSegment returns creates and opens a reference to a remote immutable segment.
 func (o *SegmentOpener) OpenSegment(table, name, path string) (ethdb.Segment, error) {
-	return NewSegment(o.Client, table, name, path), nil
+	s := NewSegment(o.Client, table, name, path)
+	s.MaxGetValueSize = o.MaxGetValueSize
+	return s, nil
 }
 
 // Ensure implementation fulfills interface.
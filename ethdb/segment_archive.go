@@ -0,0 +1,278 @@
+package ethdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+const (
+	// SegmentArchiveMagic is the magic number written at the end of a segment archive.
+	SegmentArchiveMagic = "ETHA"
+
+	// Size of the trailer containing the TOC offset & magic.
+	SegmentArchiveTrailerSize = 8 + len(SegmentArchiveMagic)
+)
+
+var (
+	ErrSegmentArchiveCorrupt = errors.New("ethdb: segment archive corrupt")
+)
+
+// SegmentArchiveWriter writes multiple file segments into a single archive
+// file. Each segment is copied byte-for-byte and located by a table of
+// contents written at the end of the file by Close().
+//
+// Archive layout:
+//
+//	[segment 0][segment 1]...[TOC][TOC offset (8)][magic (4)]
+//
+// The TOC contains a uvarint count followed by a uvarint-prefixed name,
+// 8-byte offset & 8-byte size for each segment.
+type SegmentArchiveWriter struct {
+	f      *os.File
+	offset int64
+	toc    []segmentArchiveEntry
+	err    error // set if the archive can no longer be written
+
+	// Filename of the archive to write.
+	Path string
+}
+
+// NewSegmentArchiveWriter returns a new instance of SegmentArchiveWriter.
+func NewSegmentArchiveWriter(path string) *SegmentArchiveWriter {
+	return &SegmentArchiveWriter{Path: path}
+}
+
+// Open creates the archive file.
+func (w *SegmentArchiveWriter) Open() (err error) {
+	if w.f != nil {
+		return errors.New("ethdb: file already open")
+	}
+	w.f, err = os.OpenFile(w.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	return err
+}
+
+// Add appends the file segment at path to the archive under name.
+func (w *SegmentArchiveWriter) Add(name, path string) error {
+	if w.err != nil {
+		return w.err
+	}
+	for _, e := range w.toc {
+		if e.name == name {
+			return fmt.Errorf("ethdb: duplicate segment in archive: %q", name)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Ensure source is a file segment.
+	magic := make([]byte, len(FileSegmentMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != FileSegmentMagic {
+		return fmt.Errorf("ethdb: not a file segment: %s", path)
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w.f, f)
+	if err != nil {
+		// Discard the partial copy so offsets of later segments stay valid.
+		if terr := w.f.Truncate(w.offset); terr != nil {
+			w.err = fmt.Errorf("ethdb: cannot discard partial segment: %s", terr)
+		} else if _, serr := w.f.Seek(w.offset, io.SeekStart); serr != nil {
+			w.err = fmt.Errorf("ethdb: cannot discard partial segment: %s", serr)
+		}
+		return err
+	}
+	w.toc = append(w.toc, segmentArchiveEntry{name: name, offset: w.offset, size: n})
+	w.offset += n
+	return nil
+}
+
+// Close writes the table of contents & trailer and closes the file.
+func (w *SegmentArchiveWriter) Close() error {
+	if w.f == nil {
+		return nil
+	} else if w.err != nil {
+		return w.err
+	}
+
+	var buf bytes.Buffer
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, uint64(len(w.toc)))])
+	for _, e := range w.toc {
+		buf.Write(b[:binary.PutUvarint(b, uint64(len(e.name)))])
+		buf.WriteString(e.name)
+		binary.BigEndian.PutUint64(b, uint64(e.offset))
+		buf.Write(b[:8])
+		binary.BigEndian.PutUint64(b, uint64(e.size))
+		buf.Write(b[:8])
+	}
+	binary.BigEndian.PutUint64(b, uint64(w.offset))
+	buf.Write(b[:8])
+	buf.WriteString(SegmentArchiveMagic)
+
+	if _, err := w.f.Write(buf.Bytes()); err != nil {
+		return err
+	} else if err := w.f.Sync(); err != nil {
+		return err
+	} else if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	return nil
+}
+
+// Abort closes the file handle and removes the partially written archive.
+// This is a no-op if the writer was never opened or has been closed.
+func (w *SegmentArchiveWriter) Abort() error {
+	if w.f == nil {
+		return nil
+	}
+	w.f.Close()
+	w.f = nil
+
+	if err := os.Remove(w.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SegmentArchive represents a read-only archive of file segments. The whole
+// archive is memory-mapped once and each segment reads directly from its
+// region of the mapping.
+type SegmentArchive struct {
+	path     string
+	data     []byte
+	file     *os.File
+	segments map[string]*FileSegment
+}
+
+// NewSegmentArchive returns a new instance of SegmentArchive.
+func NewSegmentArchive(path string) *SegmentArchive {
+	return &SegmentArchive{path: path}
+}
+
+// Path returns the path to the archive file.
+func (a *SegmentArchive) Path() string { return a.path }
+
+// Open memory-maps the archive and reads its table of contents.
+func (a *SegmentArchive) Open() error {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	a.file = file
+
+	data, err := mmap.Map(file, mmap.RDONLY, 0)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.data = []byte(data)
+
+	if err := a.readTOC(); err != nil {
+		a.Close()
+		return err
+	}
+	return nil
+}
+
+func (a *SegmentArchive) readTOC() error {
+	if len(a.data) < SegmentArchiveTrailerSize {
+		return fmt.Errorf("%w: trailer too short", ErrSegmentArchiveCorrupt)
+	} else if string(a.data[len(a.data)-len(SegmentArchiveMagic):]) != SegmentArchiveMagic {
+		return errors.New("ethdb: invalid segment archive")
+	}
+
+	tocEnd := int64(len(a.data) - SegmentArchiveTrailerSize)
+	tocOffset := int64(binary.BigEndian.Uint64(a.data[tocEnd:]))
+	if tocOffset < 0 || tocOffset > tocEnd {
+		return fmt.Errorf("%w: toc offset out of bounds: %d", ErrSegmentArchiveCorrupt, tocOffset)
+	}
+
+	r := bytes.NewReader(a.data[tocOffset:tocEnd])
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSegmentArchiveCorrupt, err)
+	}
+
+	a.segments = make(map[string]*FileSegment)
+	for i := uint64(0); i < n; i++ {
+		sz, err := binary.ReadUvarint(r)
+		if err != nil || sz > uint64(r.Len()) {
+			return fmt.Errorf("%w: invalid toc entry %d", ErrSegmentArchiveCorrupt, i)
+		}
+		name := make([]byte, sz)
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return fmt.Errorf("%w: invalid toc entry %d", ErrSegmentArchiveCorrupt, i)
+		} else if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("%w: invalid toc entry %d", ErrSegmentArchiveCorrupt, i)
+		}
+
+		offset, size := binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16])
+		if offset > uint64(tocOffset) || size > uint64(tocOffset)-offset {
+			return fmt.Errorf("%w: segment out of bounds: %q", ErrSegmentArchiveCorrupt, name)
+		}
+
+		s, err := NewFileSegmentFromBytes(string(name), a.data[offset:offset+size:offset+size])
+		if err != nil {
+			return fmt.Errorf("ethdb: cannot open archived segment %q: %s", name, err)
+		}
+		a.segments[string(name)] = s
+	}
+	return nil
+}
+
+// Close closes every contained segment and unmaps the archive. Segments
+// returned by Segment() return ErrFileSegmentClosed afterward.
+func (a *SegmentArchive) Close() (err error) {
+	for _, s := range a.segments {
+		s.Close()
+	}
+	a.segments = nil
+	if a.data != nil {
+		if uerr := (*mmap.MMap)(&a.data).Unmap(); uerr != nil {
+			err = uerr
+		}
+		a.data = nil
+	}
+	if a.file != nil {
+		if ferr := a.file.Close(); ferr != nil && err == nil {
+			err = ferr
+		}
+		a.file = nil
+	}
+	return err
+}
+
+// Names returns the names of all segments in the archive, in sorted order.
+func (a *SegmentArchive) Names() []string {
+	names := make([]string, 0, len(a.segments))
+	for name := range a.segments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Segment returns the segment with the given name. Returns nil if it does not exist.
+func (a *SegmentArchive) Segment(name string) *FileSegment {
+	return a.segments[name]
+}
+
+type segmentArchiveEntry struct {
+	name   string
+	offset int64
+	size   int64
+}
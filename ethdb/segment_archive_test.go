@@ -0,0 +1,89 @@
+package ethdb_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+func TestSegmentArchive(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	// Encode two segments & bundle them into an archive.
+	path := filepath.Join(dir, "archive")
+	w := ethdb.NewSegmentArchiveWriter(path)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"0001", "0000"} {
+		segmentPath := filepath.Join(dir, name)
+		if err := EncodeToFileSegment(segmentPath, [][]byte{[]byte(name)}, [][]byte{[]byte("v" + name)}); err != nil {
+			t.Fatal(err)
+		} else if err := w.Add(name, segmentPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Add("0000", filepath.Join(dir, "0000")); err == nil {
+		t.Fatal("expected duplicate error")
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := ethdb.NewSegmentArchive(path)
+	if err := a.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if names := a.Names(); !reflect.DeepEqual(names, []string{"0000", "0001"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+	for _, name := range a.Names() {
+		if v, err := a.Segment(name).Get([]byte(name)); err != nil {
+			t.Fatal(err)
+		} else if string(v) != "v"+name {
+			t.Fatalf("unexpected value: %q", v)
+		}
+	}
+	if a.Segment("0002") != nil {
+		t.Fatal("expected nil segment")
+	}
+
+	// Ensure segments handed out are closed with the archive.
+	s := a.Segment("0000")
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Get([]byte("0000")); err != ethdb.ErrFileSegmentClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSegmentArchiveWriter_Abort(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive")
+	segmentPath := filepath.Join(dir, "0000")
+	if err := EncodeToFileSegment(segmentPath, [][]byte{[]byte("foo")}, [][]byte{[]byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := ethdb.NewSegmentArchiveWriter(path)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	} else if err := w.Add("0000", segmentPath); err != nil {
+		t.Fatal(err)
+	} else if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected archive removed: %v", err)
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
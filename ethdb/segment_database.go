@@ -0,0 +1,206 @@
+package ethdb
+
+import (
+	"bytes"
+
+	"github.com/bcskill/bcschain/v3/common"
+)
+
+// Ensure implementation implements interface.
+var _ common.Table = (*SegmentDatabase)(nil)
+
+// SegmentDatabase represents a read-only table backed by a set of segments.
+// Write operations return ErrImmutableSegment.
+type SegmentDatabase struct {
+	set *SegmentSet
+
+	// If set, Get & Has only search the segment named by the key's partition.
+	// Otherwise every segment is acquired in turn until the key is found.
+	Partitioner Partitioner
+}
+
+// NewSegmentDatabase returns a new instance of SegmentDatabase.
+func NewSegmentDatabase(set *SegmentSet) *SegmentDatabase {
+	return &SegmentDatabase{set: set}
+}
+
+// Has returns true if any segment in the set contains key.
+func (db *SegmentDatabase) Has(key []byte) (bool, error) {
+	if db.Partitioner != nil {
+		return db.has(db.Partitioner.Partition(key), key)
+	}
+	for _, s := range db.set.Slice() {
+		ok, err := db.has(s.Name(), key)
+		if err != nil {
+			return false, err
+		} else if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (db *SegmentDatabase) has(name string, key []byte) (bool, error) {
+	s, err := db.set.Acquire(name)
+	if err != nil {
+		return false, err
+	} else if s == nil {
+		return false, nil
+	}
+	defer db.set.Release(s)
+	return s.Has(key)
+}
+
+// Get returns the value of key from the first segment that contains it.
+// Segments are searched in name order unless a Partitioner is set.
+func (db *SegmentDatabase) Get(key []byte) ([]byte, error) {
+	if db.Partitioner != nil {
+		return db.get(db.Partitioner.Partition(key), key)
+	}
+	for _, s := range db.set.Slice() {
+		value, err := db.get(s.Name(), key)
+		if err == common.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	return nil, common.ErrNotFound
+}
+
+func (db *SegmentDatabase) get(name string, key []byte) ([]byte, error) {
+	s, err := db.set.Acquire(name)
+	if err != nil {
+		return nil, err
+	} else if s == nil {
+		return nil, common.ErrNotFound
+	}
+	defer db.set.Release(s)
+	return s.Get(key)
+}
+
+// Put returns ErrImmutableSegment.
+func (db *SegmentDatabase) Put(key, value []byte) error { return ErrImmutableSegment }
+
+// Delete returns ErrImmutableSegment.
+func (db *SegmentDatabase) Delete(key []byte) error { return ErrImmutableSegment }
+
+// NewBatch returns a batch that returns ErrImmutableSegment on every write.
+func (db *SegmentDatabase) NewBatch() common.Batch { return &segmentDatabaseBatch{} }
+
+// NewIterator returns an iterator over all segments in name order. Only keys
+// beginning with prefix and greater than or equal to prefix+start are returned.
+// An empty prefix iterates over the whole keyspace.
+//
+// Keys are returned in segment order which is sorted when segments are built
+// from sorted sources, such as LDB segments, and partitioned by key range.
+// Iteration relies on that order: segments that implement Iteratee seek
+// directly to prefix+start, and iteration ends at the first key past prefix.
+func (db *SegmentDatabase) NewIterator(prefix, start []byte) SegmentIterator {
+	return &segmentDatabaseIterator{
+		set:      db.set,
+		segments: db.set.Slice(),
+		prefix:   prefix,
+		start:    append(append([]byte{}, prefix...), start...),
+	}
+}
+
+// segmentDatabaseIterator iterates over each segment in a set in turn.
+type segmentDatabaseIterator struct {
+	set      *SegmentSet
+	segments []Segment
+	seg      Segment // acquired segment, if itr is set
+	itr      SegmentIterator
+	err      error
+
+	prefix []byte // required key prefix
+	start  []byte // inclusive lower bound, includes prefix
+}
+
+// Next moves to the next key/value pair. Returns false when all segments
+// have been read or an error has occurred.
+func (itr *segmentDatabaseIterator) Next() bool {
+	for itr.err == nil {
+		if itr.itr != nil {
+			if itr.itr.Next() {
+				key := itr.itr.Key()
+				if !bytes.HasPrefix(key, itr.prefix) {
+					if bytes.Compare(key, itr.prefix) > 0 {
+						// Remaining keys, in this and later segments, sort after prefix.
+						itr.err, itr.segments = itr.closeSegment(), nil
+					}
+					continue
+				} else if bytes.Compare(key, itr.start) >= 0 {
+					return true
+				}
+				continue
+			}
+			itr.err = itr.closeSegment()
+			continue
+		}
+
+		if len(itr.segments) == 0 {
+			return false
+		}
+		s, err := itr.set.Acquire(itr.segments[0].Name())
+		itr.segments = itr.segments[1:]
+		if err != nil {
+			itr.err = err
+		} else if s != nil {
+			itr.seg, itr.itr = s, itr.segmentIterator(s)
+		}
+	}
+	return false
+}
+
+// segmentIterator returns an iterator over s, seeking to the start key if s
+// supports ranged iteration.
+func (itr *segmentDatabaseIterator) segmentIterator(s Segment) SegmentIterator {
+	if s, ok := s.(Iteratee); ok {
+		return s.NewIterator(itr.prefix, itr.start[len(itr.prefix):])
+	}
+	return s.Iterator()
+}
+
+func (itr *segmentDatabaseIterator) closeSegment() error {
+	err := itr.itr.Close()
+	itr.set.Release(itr.seg)
+	itr.seg, itr.itr = nil, nil
+	return err
+}
+
+// Key returns the current key.
+func (itr *segmentDatabaseIterator) Key() []byte {
+	if itr.itr == nil {
+		return nil
+	}
+	return itr.itr.Key()
+}
+
+// Value returns the current value.
+func (itr *segmentDatabaseIterator) Value() []byte {
+	if itr.itr == nil {
+		return nil
+	}
+	return itr.itr.Value()
+}
+
+// Close releases the current segment and returns any error from iteration.
+func (itr *segmentDatabaseIterator) Close() error {
+	if itr.itr != nil {
+		if err := itr.closeSegment(); err != nil && itr.err == nil {
+			itr.err = err
+		}
+	}
+	itr.segments = nil
+	return itr.err
+}
+
+type segmentDatabaseBatch struct{}
+
+func (b *segmentDatabaseBatch) Put(key, value []byte) error { return ErrImmutableSegment }
+func (b *segmentDatabaseBatch) Delete(key []byte) error     { return ErrImmutableSegment }
+func (b *segmentDatabaseBatch) Write() error                { return ErrImmutableSegment }
+func (b *segmentDatabaseBatch) ValueSize() int              { return 0 }
+func (b *segmentDatabaseBatch) Reset()                      {}
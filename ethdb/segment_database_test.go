@@ -0,0 +1,179 @@
+package ethdb_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/common"
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+// MustOpenSegmentSet returns a segment set containing one file segment per
+// entry in data. Segments are named by their index in data.
+func MustOpenSegmentSet(dir string, data [][][]byte) *ethdb.SegmentSet {
+	ss := ethdb.NewSegmentSet(len(data))
+	for i, keys := range data {
+		name := string(rune('0' + i))
+		path := filepath.Join(dir, name)
+		if err := EncodeToFileSegment(path, keys, keys); err != nil {
+			panic(err)
+		}
+		ss.Add(ethdb.NewFileSegment(name, path))
+	}
+	return ss
+}
+
+func TestSegmentDatabase(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	ss := MustOpenSegmentSet(dir, [][][]byte{
+		{[]byte("a"), []byte("b")},
+		{[]byte("c"), []byte("d")},
+	})
+	defer ss.Close()
+	db := ethdb.NewSegmentDatabase(ss)
+
+	t.Run("Get", func(t *testing.T) {
+		if v, err := db.Get([]byte("c")); err != nil {
+			t.Fatal(err)
+		} else if string(v) != "c" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if _, err := db.Get([]byte("z")); err != common.ErrNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Has", func(t *testing.T) {
+		if ok, err := db.Has([]byte("b")); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected key")
+		}
+		if ok, err := db.Has([]byte("z")); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatal("unexpected key")
+		}
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		if keys := MustReadSegmentDatabaseKeys(db, nil, nil); !reflect.DeepEqual(keys, []string{"a", "b", "c", "d"}) {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+	})
+
+	t.Run("Immutable", func(t *testing.T) {
+		if err := db.Put([]byte("e"), []byte("e")); err != ethdb.ErrImmutableSegment {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := db.Delete([]byte("a")); err != ethdb.ErrImmutableSegment {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := db.NewBatch().Write(); err != ethdb.ErrImmutableSegment {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// Ensure a partitioned database only acquires the key's segment.
+func TestSegmentDatabase_Partitioner(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	ss := MustOpenSegmentSet(dir, [][][]byte{
+		{[]byte("a"), []byte("b")},
+		{[]byte("c"), []byte("d")},
+	})
+	defer ss.Close()
+	db := ethdb.NewSegmentDatabase(ss)
+	db.Partitioner = ethdb.PartitionFunc(func(key []byte) string {
+		if key[0] < 'c' {
+			return "0"
+		}
+		return "1"
+	})
+
+	// Opening the first segment would now fail.
+	if err := os.Remove(filepath.Join(dir, "0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get([]byte("d")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "d" {
+		t.Fatalf("unexpected value: %q", v)
+	} else if _, err := db.Get([]byte("e")); err != common.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok, err := db.Has([]byte("c")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected key")
+	}
+}
+
+func TestSegmentDatabase_NewIterator(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	ss := MustOpenSegmentSet(dir, [][][]byte{
+		{[]byte("a1"), []byte("a2"), []byte("b1")},
+		{[]byte("b2"), []byte("b3"), []byte("c1")},
+	})
+	defer ss.Close()
+	db := ethdb.NewSegmentDatabase(ss)
+
+	for _, tt := range []struct {
+		name          string
+		prefix, start []byte
+		keys          []string
+	}{
+		{"Prefix", []byte("b"), nil, []string{"b1", "b2", "b3"}},
+		{"PrefixStart", []byte("b"), []byte("2"), []string{"b2", "b3"}},
+		{"Start", nil, []byte("b3"), []string{"b3", "c1"}},
+		{"StartBeyondRange", []byte("b"), []byte("9"), nil},
+		{"NoMatch", []byte("z"), nil, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if keys := MustReadSegmentDatabaseKeys(db, tt.prefix, tt.start); !reflect.DeepEqual(keys, tt.keys) {
+				t.Fatalf("unexpected keys: %v", keys)
+			}
+		})
+	}
+}
+
+// Ensure segments after the prefix range are never opened.
+func TestSegmentDatabase_NewIterator_StopPastPrefix(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	ss := MustOpenSegmentSet(dir, [][][]byte{
+		{[]byte("a1"), []byte("a2"), []byte("b1")},
+		{[]byte("c1")},
+	})
+	defer ss.Close()
+	db := ethdb.NewSegmentDatabase(ss)
+
+	// Opening the second segment would now fail & surface from Close().
+	if err := os.Remove(filepath.Join(dir, "1")); err != nil {
+		t.Fatal(err)
+	}
+	if keys := MustReadSegmentDatabaseKeys(db, []byte("a"), nil); !reflect.DeepEqual(keys, []string{"a1", "a2"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// MustReadSegmentDatabaseKeys returns all keys from a database iterator.
+func MustReadSegmentDatabaseKeys(db *ethdb.SegmentDatabase, prefix, start []byte) []string {
+	itr := db.NewIterator(prefix, start)
+	var keys []string
+	for itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	if err := itr.Close(); err != nil {
+		panic(err)
+	}
+	return keys
+}
@@ -0,0 +1,64 @@
+package ethdb
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// ExportOptions represents options for ExportJSON & ExportCSV.
+type ExportOptions struct {
+	// Maximum number of entries to write. Zero writes all entries.
+	Limit int
+
+	// Formats each value for output. Values are hex-encoded if nil.
+	FormatValue func(value []byte) string
+}
+
+// ExportJSON writes each entry of s to w as a JSON object on its own line
+// with hex-encoded "key" and formatted "value" fields. Entries are written in
+// iteration order so exports of identical segments are byte-for-byte equal.
+func ExportJSON(w io.Writer, s Segment, opt ExportOptions) error {
+	enc := json.NewEncoder(w)
+	return exportEntries(s, opt, func(key, value string) error {
+		return enc.Encode(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}{key, value})
+	})
+}
+
+// ExportCSV writes each entry of s to w as a CSV record with a hex-encoded
+// key and formatted value. The first record is a "key,value" header.
+func ExportCSV(w io.Writer, s Segment, opt ExportOptions) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "value"}); err != nil {
+		return err
+	}
+	if err := exportEntries(s, opt, func(key, value string) error {
+		return cw.Write([]string{key, value})
+	}); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportEntries calls fn with the formatted key & value of each entry in s.
+func exportEntries(s Segment, opt ExportOptions, fn func(key, value string) error) error {
+	format := opt.FormatValue
+	if format == nil {
+		format = hex.EncodeToString
+	}
+
+	itr := s.Iterator()
+	defer itr.Close()
+
+	for n := 0; (opt.Limit <= 0 || n < opt.Limit) && itr.Next(); n++ {
+		if err := fn(hex.EncodeToString(itr.Key()), format(itr.Value())); err != nil {
+			return err
+		}
+	}
+	return itr.Close()
+}
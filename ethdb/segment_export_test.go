@@ -0,0 +1,43 @@
+package ethdb_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+func TestExportJSON(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+	defer s.Close()
+
+	t.Run("OK", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ethdb.ExportJSON(&buf, s, ethdb.ExportOptions{}); err != nil {
+			t.Fatal(err)
+		} else if got, exp := buf.String(), "{\"key\":\"61\",\"value\":\"31\"}\n{\"key\":\"62\",\"value\":\"32\"}\n"; got != exp {
+			t.Fatalf("unexpected output: %s", got)
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ethdb.ExportJSON(&buf, s, ethdb.ExportOptions{Limit: 1, FormatValue: func(v []byte) string { return string(v) }}); err != nil {
+			t.Fatal(err)
+		} else if got, exp := buf.String(), "{\"key\":\"61\",\"value\":\"1\"}\n"; got != exp {
+			t.Fatalf("unexpected output: %s", got)
+		}
+	})
+}
+
+func TestExportCSV(t *testing.T) {
+	s := MustOpenFileSegment([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+	defer s.Close()
+
+	var buf bytes.Buffer
+	if err := ethdb.ExportCSV(&buf, s, ethdb.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	} else if got, exp := buf.String(), "key,value\n61,31\n62,32\n"; got != exp {
+		t.Fatalf("unexpected output: %s", got)
+	}
+}
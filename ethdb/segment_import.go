@@ -0,0 +1,33 @@
+package ethdb
+
+import "github.com/bcskill/bcschain/v3/common"
+
+// ImportSegment writes all key/value pairs from s into tbl using batches.
+// Batches are written once their value size reaches batchSize. If batchSize
+// is zero then IdealBatchSize is used.
+func ImportSegment(tbl common.Table, s Segment, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = IdealBatchSize
+	}
+
+	itr := s.Iterator()
+	defer itr.Close()
+
+	batch := tbl.NewBatch()
+	for itr.Next() {
+		if err := batch.Put(itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+
+		if batch.ValueSize() >= batchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
+	return batch.Write()
+}
@@ -0,0 +1,36 @@
+package ethdb_test
+
+import (
+	"testing"
+
+	"github.com/bcskill/bcschain/v3/common"
+	"github.com/bcskill/bcschain/v3/ethdb"
+)
+
+func TestImportSegment(t *testing.T) {
+	s := MustOpenFileSegment(
+		[][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		[][]byte{[]byte("1"), []byte("2"), []byte("3")},
+	)
+	defer s.Close()
+
+	// Use a small batch size to force multiple batch writes.
+	db := ethdb.NewMemDatabase()
+	if err := ethdb.ImportSegment(db, s, 2); err != nil {
+		t.Fatal(err)
+	} else if db.Len() != 3 {
+		t.Fatalf("unexpected len: %d", db.Len())
+	}
+
+	for key, value := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if v, err := db.Get([]byte(key)); err != nil {
+			t.Fatal(err)
+		} else if string(v) != value {
+			t.Fatalf("unexpected value for %q: %q", key, v)
+		}
+	}
+
+	if _, err := db.Get([]byte("d")); err != common.ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
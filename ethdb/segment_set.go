@@ -12,11 +12,18 @@ import (
 
 // SegmentSet represents a set of segments.
 type SegmentSet struct {
-	mu       sync.RWMutex
-	segments map[string]Segment // all segments
+	mu         sync.RWMutex
+	segments   map[string]Segment // all segments
+	generation uint64             // incremented on every Apply
 
 	semaphore *semaphore.Weighted // cache semaphore
 	cache     *lru.Cache          // opened segments
+
+	refmu   sync.Mutex                // guards cache mutation & the fields below
+	refs    map[Segment]int           // number of Acquire() calls not yet released
+	retired map[Segment]bool          // evicted while acquired; retired on last Release()
+	pending map[Segment]chan struct{} // being opened or retired; closed when done
+	evicted []Segment                 // evicted by the current cache call
 }
 
 // NewSegmentSet returns a new instance of SegmentSet.
@@ -28,6 +35,9 @@ func NewSegmentSet(maxOpenCount int) *SegmentSet {
 	ss := &SegmentSet{
 		semaphore: semaphore.NewWeighted(int64(maxOpenCount)),
 		segments:  make(map[string]Segment),
+		refs:      make(map[Segment]int),
+		retired:   make(map[Segment]bool),
+		pending:   make(map[Segment]chan struct{}),
 	}
 	ss.cache, _ = lru.NewWithEvict(maxOpenCount, ss.onEvicted)
 	return ss
@@ -56,7 +66,8 @@ func (ss *SegmentSet) Contains(name string) bool {
 	return ok
 }
 
-// Remove removes the segment with the given name from the set.
+// Remove removes the segment with the given name from the set. The segment is
+// closed once every reader that acquired it has called Release().
 func (ss *SegmentSet) Remove(ctx context.Context, name string) {
 	ss.mu.Lock()
 	delete(ss.segments, name)
@@ -65,55 +76,214 @@ func (ss *SegmentSet) Remove(ctx context.Context, name string) {
 	if ss.semaphore.Acquire(ctx, 1) != nil {
 		return // cache Purge will Remove this segment
 	}
-	ss.cache.Remove(name)
+	ss.refmu.Lock()
+	ss.evict(name)
+	a := ss.takeEvicted()
+	ss.refmu.Unlock()
+	ss.retireAll(a)
 	ss.semaphore.Release(1)
 }
 
+// Apply adds and removes segments from the set as a single change so readers
+// never observe a partial update. A segment in add may replace a segment in
+// remove with the same name. Removed segments are evicted from the open
+// segment cache and closed once every reader that acquired them has called
+// Release(). Apply increments the generation.
+func (ss *SegmentSet) Apply(add, remove []Segment) {
+	ss.mu.Lock()
+	for _, s := range remove {
+		delete(ss.segments, s.Name())
+	}
+	for _, s := range add {
+		ss.segments[s.Name()] = s
+	}
+	ss.generation++
+	ss.mu.Unlock()
+
+	// Evict by name so a replaced segment is never served from the cache.
+	ss.refmu.Lock()
+	for _, s := range remove {
+		ss.evict(s.Name())
+	}
+	a := ss.takeEvicted()
+	ss.refmu.Unlock()
+	ss.retireAll(a)
+}
+
+// Generation returns the number of times Apply has been called. Readers can
+// compare generations to detect that the set has changed.
+func (ss *SegmentSet) Generation() uint64 {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.generation
+}
+
 // Acquire returns a segment by name from the set and adds increments the semaphore.
 // If the segment is unopened then it is opened before returning. If a segment
-// is successfully retruns then Release() must always be called by the caller.
+// is successfully returned then Release() must always be called with it by the caller.
+//
+// Segments are opened without holding refmu so a slow open only blocks
+// readers of the same segment.
 func (ss *SegmentSet) Acquire(name string) (Segment, error) {
 	ss.semaphore.Acquire(context.Background(), 1)
 
-	// Fetch from open segment cache first.
-	if s, ok := ss.cache.Get(name); ok {
-		return s.(Segment), nil
-	}
+	for {
+		ss.refmu.Lock()
 
-	// Attempt to fetch from set of all segments.
-	ss.mu.RLock()
-	s := ss.segments[name]
-	ss.mu.RUnlock()
-	if s == nil {
-		ss.semaphore.Release(1)
-		return nil, nil
-	}
+		// Fetch from open segment cache first.
+		if s, ok := ss.cache.Get(name); ok {
+			ss.refs[s.(Segment)]++
+			ss.refmu.Unlock()
+			return s.(Segment), nil
+		}
 
-	// Open and add to cache.
-	if s, ok := s.(interface {
-		Open() error
-	}); ok {
-		if err := s.Open(); err != nil {
+		// Attempt to fetch from set of all segments.
+		ss.mu.RLock()
+		s := ss.segments[name]
+		ss.mu.RUnlock()
+		if s == nil {
+			ss.refmu.Unlock()
 			ss.semaphore.Release(1)
-			return nil, err
+			return nil, nil
+		}
+
+		// Wait for another reader's open, or a pending retire, to finish.
+		if ch := ss.pending[s]; ch != nil {
+			ss.refmu.Unlock()
+			<-ch
+			continue
+		}
+
+		// Open unless a reader still holds it open after an eviction.
+		if ss.refs[s] == 0 {
+			if err := ss.open(s); err != nil {
+				ss.refmu.Unlock()
+				ss.semaphore.Release(1)
+				return nil, err
+			}
+		}
+		ss.refs[s]++
+		delete(ss.retired, s)
+
+		// Cache unless s was removed from the set while opening, in which
+		// case the last Release() closes it. Retire anything evicted to make room.
+		ss.mu.RLock()
+		current := ss.segments[name] == s
+		ss.mu.RUnlock()
+		if current {
+			ss.cache.Add(name, s)
+		} else {
+			ss.retired[s] = true
 		}
+		a := ss.takeEvicted()
+		ss.refmu.Unlock()
+		ss.retireAll(a)
+
+		return s, nil
 	}
-	ss.cache.Add(name, s)
+}
 
-	return s, nil
+// open opens s, if it supports opening, with refmu released. Readers of s
+// wait on its pending channel until the open completes. Must be called with
+// refmu held; it is held again on return.
+func (ss *SegmentSet) open(s Segment) error {
+	opener, ok := s.(interface {
+		Open() error
+	})
+	if !ok {
+		return nil
+	}
+
+	ch := make(chan struct{})
+	ss.pending[s] = ch
+	ss.refmu.Unlock()
+
+	err := opener.Open()
+
+	ss.refmu.Lock()
+	delete(ss.pending, s)
+	close(ch)
+	return err
 }
 
-// Release decrements the semaphore on the set.
-func (ss *SegmentSet) Release() {
+// Release releases a segment returned by Acquire() and decrements the
+// semaphore on the set. A segment evicted or removed while acquired is
+// retired by the last call to Release().
+func (ss *SegmentSet) Release(s Segment) {
+	var a []Segment
+	ss.refmu.Lock()
+	if ss.refs[s]--; ss.refs[s] <= 0 {
+		delete(ss.refs, s)
+		if ss.retired[s] {
+			delete(ss.retired, s)
+			ss.pending[s] = make(chan struct{})
+			a = append(a, s)
+		}
+	}
+	ss.refmu.Unlock()
+	ss.retireAll(a)
 	ss.semaphore.Release(1)
 }
 
+// onEvicted is called by the cache when a segment is evicted. Every cache
+// call that can evict is made with refmu held so evictions are only recorded
+// here and handled by takeEvicted() once the cache call returns.
 func (ss *SegmentSet) onEvicted(key, value interface{}) {
-	ss.mu.Lock()
-	s := ss.segments[key.(string)]
-	ss.mu.Unlock()
+	ss.evicted = append(ss.evicted, value.(Segment))
+}
+
+// evict removes name from the cache. The cache's Remove() does not invoke
+// the eviction callback so the segment is recorded here. Must be called with
+// refmu held.
+func (ss *SegmentSet) evict(name string) {
+	if v, ok := ss.cache.Peek(name); ok {
+		ss.cache.Remove(name)
+		ss.evicted = append(ss.evicted, v.(Segment))
+	}
+}
 
-	if s == nil {
+// takeEvicted returns the evicted segments that are not acquired and marks
+// them pending so they cannot be reopened until passed to retireAll(). The
+// rest are retired by their last Release(). Must be called with refmu held.
+func (ss *SegmentSet) takeEvicted() []Segment {
+	var a []Segment
+	for _, s := range ss.evicted {
+		if ss.refs[s] > 0 {
+			ss.retired[s] = true
+		} else if ss.pending[s] == nil {
+			ss.pending[s] = make(chan struct{})
+			a = append(a, s)
+		}
+	}
+	ss.evicted = ss.evicted[:0]
+	return a
+}
+
+// retireAll retires each segment returned by takeEvicted() and wakes any
+// reader waiting to reopen it. Must be called without refmu held.
+func (ss *SegmentSet) retireAll(a []Segment) {
+	for _, s := range a {
+		ss.retire(s)
+
+		ss.refmu.Lock()
+		close(ss.pending[s])
+		delete(ss.pending, s)
+		ss.refmu.Unlock()
+	}
+}
+
+// retire purges or closes an evicted segment. Segments dropped from the
+// cache to make room are purged, if supported, so they can be refetched.
+// Segments no longer in the set are closed.
+func (ss *SegmentSet) retire(s Segment) {
+	ss.mu.RLock()
+	current := ss.segments[s.Name()] == s
+	ss.mu.RUnlock()
+
+	if !current {
+		if err := s.Close(); err != nil {
+			log.Error("Failed to close segment", "name", s.Name(), "path", s.Path(), "error", err)
+		}
 		return
 	}
 
@@ -140,17 +310,24 @@ func (ss *SegmentSet) Close() error {
 	ss.mu.Lock()
 	ss.segments = map[string]Segment{}
 	ss.mu.Unlock()
-	// Evict all
+
+	// Evict all. Acquired segments are closed on their last Release().
+	ss.refmu.Lock()
 	ss.cache.Purge()
+	a := ss.takeEvicted()
+	ss.refmu.Unlock()
+	ss.retireAll(a)
 	return nil
 }
 
 // Slice returns a slice of all segments.
 func (ss *SegmentSet) Slice() []Segment {
+	ss.mu.RLock()
 	a := make([]Segment, 0, len(ss.segments))
 	for _, s := range ss.segments {
 		a = append(a, s)
 	}
+	ss.mu.RUnlock()
 	SortSegments(a)
 	return a
 }
@@ -1,6 +1,7 @@
 package ethdb_test
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -80,7 +81,7 @@ func TestSegmentSet_AcquireRelease(t *testing.T) {
 	}
 
 	// Release one of the segments.
-	ss.Release() // #0
+	ss.Release(segment0) // #0
 
 	// Wait for acquisition to complete.
 	<-acquired
@@ -94,8 +95,8 @@ func TestSegmentSet_AcquireRelease(t *testing.T) {
 		t.Fatal("expected purge(2)")
 	}
 
-	ss.Release() // #1
-	ss.Release() // #2
+	ss.Release(segment1) // #1
+	ss.Release(segment2) // #2
 }
 
 type purgeableSegment struct {
@@ -113,3 +114,145 @@ func (s *purgeableSegment) Purge() error {
 	s.purged = true
 	return nil
 }
+
+func TestSegmentSet_Apply(t *testing.T) {
+	segment0 := &mock.Segment{NameFunc: func() string { return "0000" }}
+	segment1 := &mock.Segment{NameFunc: func() string { return "0001" }}
+	segment2 := &mock.Segment{NameFunc: func() string { return "0002" }}
+
+	ss := ethdb.NewSegmentSet(2)
+	ss.Add(segment0)
+	ss.Add(segment1)
+
+	ss.Apply([]ethdb.Segment{segment2}, []ethdb.Segment{segment0, segment1})
+	if ss.Contains("0000") || ss.Contains("0001") {
+		t.Fatal("expected segments removed")
+	} else if !ss.Contains("0002") {
+		t.Fatal("expected segment added")
+	} else if n := ss.Len(); n != 1 {
+		t.Fatalf("unexpected len: %d", n)
+	} else if g := ss.Generation(); g != 1 {
+		t.Fatalf("unexpected generation: %d", g)
+	}
+}
+
+// Ensure a segment replaced by Apply is no longer served from the cache and
+// is only closed after its last reader releases it.
+func TestSegmentSet_Apply_Replace(t *testing.T) {
+	var closed0, closed1 bool
+	segment0 := &mock.Segment{
+		NameFunc:  func() string { return "0000" },
+		CloseFunc: func() error { closed0 = true; return nil },
+	}
+	segment1 := &mock.Segment{
+		NameFunc:  func() string { return "0000" },
+		CloseFunc: func() error { closed1 = true; return nil },
+	}
+
+	ss := ethdb.NewSegmentSet(2)
+	ss.Add(segment0)
+
+	// Hold the original segment open across the swap.
+	s0, err := ss.Acquire("0000")
+	if err != nil {
+		t.Fatal(err)
+	} else if s0 != segment0 {
+		t.Fatal("unexpected segment(0)")
+	}
+
+	ss.Apply([]ethdb.Segment{segment1}, []ethdb.Segment{segment0})
+
+	if s, err := ss.Acquire("0000"); err != nil {
+		t.Fatal(err)
+	} else if s != segment1 {
+		t.Fatal("expected replacement segment")
+	} else {
+		ss.Release(s)
+	}
+	if closed0 {
+		t.Fatal("unexpected close before release")
+	}
+
+	ss.Release(s0)
+	if !closed0 {
+		t.Fatal("expected close after last release")
+	} else if closed1 {
+		t.Fatal("unexpected close of replacement")
+	}
+}
+
+// Ensure a slow open does not block readers of other segments.
+func TestSegmentSet_Acquire_SlowOpen(t *testing.T) {
+	unblock := make(chan struct{})
+	segment0 := &openableSegment{
+		Segment:  &mock.Segment{NameFunc: func() string { return "0000" }},
+		OpenFunc: func() error { <-unblock; return nil },
+	}
+	segment1 := &openableSegment{
+		Segment:  &mock.Segment{NameFunc: func() string { return "0001" }},
+		OpenFunc: func() error { return nil },
+	}
+
+	ss := ethdb.NewSegmentSet(4)
+	ss.Add(segment0)
+	ss.Add(segment1)
+
+	// Two readers wait on the same slow open.
+	done := make(chan ethdb.Segment, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s, err := ss.Acquire("0000")
+			if err != nil {
+				panic(err)
+			}
+			done <- s
+		}()
+	}
+
+	for segment0.OpenN() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s, err := ss.Acquire("0001"); err != nil {
+		t.Fatal(err)
+	} else if s != segment1 {
+		t.Fatal("unexpected segment(1)")
+	} else {
+		ss.Release(s)
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if s := <-done; s != segment0 {
+			t.Fatal("unexpected segment(0)")
+		} else {
+			ss.Release(s)
+		}
+	}
+	if n := segment0.OpenN(); n != 1 {
+		t.Fatalf("unexpected open count: %d", n)
+	}
+}
+
+// openableSegment is a segment whose Open() calls OpenFunc and is counted.
+type openableSegment struct {
+	ethdb.Segment
+	OpenFunc func() error
+
+	mu    sync.Mutex
+	openN int
+}
+
+func (m *openableSegment) Open() error {
+	m.mu.Lock()
+	m.openN++
+	m.mu.Unlock()
+	return m.OpenFunc()
+}
+
+// OpenN returns the number of calls to Open().
+func (m *openableSegment) OpenN() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openN
+}
@@ -160,7 +160,7 @@ func (t *Table) ReleaseSegment(s Segment) {
 	case *LDBSegment:
 		return
 	default:
-		t.segments.Release()
+		t.segments.Release(s)
 	}
 }
 
@@ -364,7 +364,7 @@ func (t *Table) uncompact(ctx context.Context, name string) (*LDBSegment, error)
 	if err != nil {
 		return nil, err
 	}
-	defer t.segments.Release()
+	defer t.segments.Release(s)
 
 	ldbSegment, err := t.SegmentCompactor.UncompactSegment(ctx, t.Name, s)
 	if err != nil {